@@ -43,7 +43,7 @@ func combinedREPL(tcpstack *tcpstack.TCPStack, ipstack *ipstack.IPStack) {
 	scanner := bufio.NewScanner(os.Stdin)
 	// fmt.Println("REPL started. Type 'help' for TCP command instructions, and iphelp for IP command instructions.")
 
-	tcp_args := []string{"a", "c", "ls", "s", "sf", "rf", "r", "rtrinfo", "cl", "rst"}
+	tcp_args := []string{"a", "c", "ls", "s", "sf", "rf", "r", "rtrinfo", "cl", "rst", "cc", "nodelay", "keepalive"}
 	ip_args := []string{"down", "up", "send", "li", "lr", "ln", "exit"}
 
 	OuterLoop: 
@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"ip-rip-in-peace/pkg/bgp"
 	"ip-rip-in-peace/pkg/ipstack"
 	"os"
 	"ip-rip-in-peace/pkg/lnxconfig"
+	"ip-rip-in-peace/pkg/tcpstack"
 )
 
 func main() {
@@ -26,11 +28,23 @@ func main() {
 	if stack.IPConfig.RoutingMode == lnxconfig.RoutingTypeRIP {
 		stack.RegisterHandler(ipstack.RIP_PROTOCOL, ipstack.RIPHandler)   // RIP protocol
 	}
+	if stack.IPConfig.RoutingMode == lnxconfig.RoutingTypeLS {
+		stack.InitLinkState()
+		stack.RegisterHandler(ipstack.LS_PROTOCOL, ipstack.LSHandler) // Link-state protocol
+	}
+
+	if len(stack.IPConfig.BfdNeighbors) > 0 {
+		stack.RegisterHandler(ipstack.BFD_PROTOCOL, ipstack.BFDHandler) // Neighbor liveness
+	}
 
 	for _, iface := range stack.Interfaces {
 		go ipstack.InterfaceListen(iface, stack)
 	}
 
+	if len(stack.IPConfig.BfdNeighbors) > 0 {
+		go stack.BFDLoop()
+	}
+
 	if stack.IPConfig.RoutingMode == lnxconfig.RoutingTypeRIP {
 		// Send initial RIP request
 		stack.SendRIPRequest()
@@ -42,7 +56,24 @@ func main() {
 		go stack.RIPTimeoutCheck(stack.IPConfig.RipTimeoutThreshold)
 	}
 
-	
+	if stack.IPConfig.RoutingMode == lnxconfig.RoutingTypeLS {
+		// Start hellos and LSA aging
+		go stack.LSHelloLoop()
+		go stack.LSAgingLoop()
+	}
+
+
+	if stack.IPConfig.BgpAS != 0 {
+		// BGP sessions run over our own TCP, which routers otherwise don't start
+		tcpStack := tcpstack.InitTCPStack(stack)
+		stack.RegisterHandler(ipstack.TCP_PROTOCOL, func(packet *ipstack.IPPacket, ipStack *ipstack.IPStack) {
+			tcpStack.HandlePacket(packet.SourceIP, packet.DestinationIP, packet.Payload)
+		})
+
+		speaker := bgp.NewSpeaker(stack, tcpStack)
+		stack.RegisterCommand("bgp", speaker.ReplCommand)
+		speaker.Start()
+	}
 
 	stack.Repl()
 }
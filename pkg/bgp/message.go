@@ -0,0 +1,132 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// Every message on a session starts with its total length and type
+const HEADER_LEN = 3
+
+type MessageType uint8
+
+const (
+	MSG_OPEN      MessageType = 1
+	MSG_UPDATE    MessageType = 2
+	MSG_KEEPALIVE MessageType = 3
+)
+
+type Message struct {
+	Type MessageType
+
+	// OPEN
+	AS       uint32
+	RouterID netip.Addr
+
+	// UPDATE
+	Withdrawn []netip.Prefix
+	Announced []Announcement
+}
+
+// A reachable prefix together with the AS path to it, nearest AS first
+type Announcement struct {
+	Prefix netip.Prefix
+	ASPath []uint32
+}
+
+func MarshalMessage(message Message) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	fields := make([]any, 0)
+	switch message.Type {
+	case MSG_OPEN:
+		fields = append(fields, message.AS, message.RouterID.As4())
+	case MSG_UPDATE:
+		fields = append(fields, uint16(len(message.Withdrawn)))
+		for _, prefix := range message.Withdrawn {
+			fields = append(fields, prefix.Addr().As4(), uint8(prefix.Bits()))
+		}
+		fields = append(fields, uint16(len(message.Announced)))
+		for _, announcement := range message.Announced {
+			fields = append(fields, announcement.Prefix.Addr().As4(), uint8(announcement.Prefix.Bits()),
+				uint8(len(announcement.ASPath)), announcement.ASPath)
+		}
+	}
+
+	for _, field := range fields {
+		err := binary.Write(buf, binary.BigEndian, field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if buf.Len()+HEADER_LEN > 0xFFFF {
+		return nil, errors.New("message too large")
+	}
+
+	header := make([]byte, HEADER_LEN)
+	binary.BigEndian.PutUint16(header[0:2], uint16(buf.Len()+HEADER_LEN))
+	header[2] = uint8(message.Type)
+
+	return append(header, buf.Bytes()...), nil
+}
+
+// Parses a message body, the header has already been read off the stream
+func UnmarshalMessage(msgType MessageType, body []byte) (Message, error) {
+	buf := bytes.NewBuffer(body)
+	message := Message{Type: msgType}
+
+	var count uint16
+	var addr [4]byte
+	var bits uint8
+
+	switch msgType {
+	case MSG_OPEN:
+		if err := binary.Read(buf, binary.BigEndian, &message.AS); err != nil {
+			return Message{}, err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &addr); err != nil {
+			return Message{}, err
+		}
+		message.RouterID = netip.AddrFrom4(addr)
+	case MSG_UPDATE:
+		if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+			return Message{}, err
+		}
+		for i := 0; i < int(count); i++ {
+			for _, field := range []any{&addr, &bits} {
+				if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+					return Message{}, err
+				}
+			}
+			message.Withdrawn = append(message.Withdrawn, netip.PrefixFrom(netip.AddrFrom4(addr), int(bits)))
+		}
+
+		if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+			return Message{}, err
+		}
+		for i := 0; i < int(count); i++ {
+			var pathLen uint8
+			for _, field := range []any{&addr, &bits, &pathLen} {
+				if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+					return Message{}, err
+				}
+			}
+			path := make([]uint32, pathLen)
+			if err := binary.Read(buf, binary.BigEndian, path); err != nil {
+				return Message{}, err
+			}
+			message.Announced = append(message.Announced, Announcement{
+				Prefix: netip.PrefixFrom(netip.AddrFrom4(addr), int(bits)),
+				ASPath: path,
+			})
+		}
+	case MSG_KEEPALIVE:
+	default:
+		return Message{}, errors.New("unknown message type")
+	}
+
+	return message, nil
+}
@@ -0,0 +1,196 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ip-rip-in-peace/pkg/tcpstack"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// One TCP connection to a peer
+// Writes go through a channel so a stalled connection never blocks the speaker
+type session struct {
+	socket   *tcpstack.NormalSocket
+	out      chan []byte
+	done     chan struct{}
+	lastRecv time.Time
+
+	overflow     chan struct{} // Closed once a message didn't fit in out
+	overflowOnce sync.Once
+}
+
+// Starts the reader, writer and timers for a new connection and sends our OPEN
+// Must be called with the speaker mutex held
+func (sp *Speaker) startSession(peer *Peer, socket *tcpstack.NormalSocket) {
+	sess := &session{
+		socket:   socket,
+		out:      make(chan []byte, 64),
+		done:     make(chan struct{}),
+		lastRecv: time.Now(),
+		overflow: make(chan struct{}),
+	}
+	peer.session = sess
+	peer.State = PeerOpenSent
+
+	go sess.writeLoop()
+	go sp.readLoop(peer, sess)
+	go sp.timerLoop(peer, sess)
+
+	sess.send(Message{Type: MSG_OPEN, AS: sp.AS, RouterID: sp.RouterID})
+}
+
+// Queues a message without blocking, since callers hold the speaker mutex
+// If the connection has fallen too far behind the message can't be queued, and the peer would miss an
+// UPDATE we already count as advertised. The session is torn down instead, see timerLoop, and the full
+// table goes out again once it is re-established
+func (sess *session) send(message Message) {
+	data, err := MarshalMessage(message)
+	if err != nil {
+		slog.Error("Error marshalling BGP message", "error", err)
+		return
+	}
+
+	select {
+	case <-sess.overflow:
+		// Nothing after a dropped message may reach the peer
+		return
+	default:
+	}
+
+	select {
+	case sess.out <- data:
+	default:
+		sess.overflowOnce.Do(func() { close(sess.overflow) })
+	}
+}
+
+func (sess *session) writeLoop() {
+	for {
+		select {
+		case data := <-sess.out:
+			if err := sess.socket.VWrite(data); err != nil {
+				return
+			}
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+func (sp *Speaker) readLoop(peer *Peer, sess *session) {
+	for {
+		message, err := readMessage(sess.socket)
+		if err != nil {
+			sp.sessionDown(peer, sess, err)
+			return
+		}
+
+		sp.mutex.Lock()
+		if peer.session != sess {
+			sp.mutex.Unlock()
+			return
+		}
+		sess.lastRecv = time.Now()
+
+		switch message.Type {
+		case MSG_OPEN:
+			if message.AS != peer.RemoteAS {
+				sp.mutex.Unlock()
+				sp.sessionDown(peer, sess, fmt.Errorf("peer sent AS %d, expected %d", message.AS, peer.RemoteAS))
+				return
+			}
+			peer.RouterID = message.RouterID
+			peer.State = PeerEstablished
+			sp.advertise(peer)
+		case MSG_UPDATE:
+			if peer.State == PeerEstablished {
+				sp.processUpdate(peer, message)
+			}
+		}
+		sp.mutex.Unlock()
+	}
+}
+
+// Sends keepalives and takes the session down if the peer goes quiet for the hold time
+// or our send queue overflowed
+func (sp *Speaker) timerLoop(peer *Peer, sess *session) {
+	ticker := time.NewTicker(sp.config.BgpKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sess.overflow:
+			sp.sessionDown(peer, sess, errors.New("send queue overflow"))
+			return
+		case <-sess.done:
+			return
+		}
+
+		sp.mutex.Lock()
+		expired := time.Since(sess.lastRecv) > sp.config.BgpHoldTime
+		sp.mutex.Unlock()
+
+		if expired {
+			sp.sessionDown(peer, sess, errors.New("hold timer expired"))
+			return
+		}
+		sess.send(Message{Type: MSG_KEEPALIVE})
+	}
+}
+
+// Forgets everything learned over a session and closes it
+func (sp *Speaker) sessionDown(peer *Peer, sess *session, reason error) {
+	sp.mutex.Lock()
+	if peer.session != sess {
+		sp.mutex.Unlock()
+		return
+	}
+
+	slog.Info("BGP session down", "peer", peer.Address, "reason", reason)
+	close(sess.done)
+	peer.session = nil
+	peer.State = PeerIdle
+	peer.RouterID = netip.Addr{}
+	peer.routesIn = make(map[netip.Prefix]*Route)
+	peer.advertised = make(map[netip.Prefix][]uint32)
+	sp.decide()
+	sp.mutex.Unlock()
+
+	go sess.socket.VClose()
+}
+
+// Reads one whole message off the stream
+func readMessage(socket *tcpstack.NormalSocket) (Message, error) {
+	header := make([]byte, HEADER_LEN)
+	if err := readFull(socket, header); err != nil {
+		return Message{}, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[0:2]))
+	if length < HEADER_LEN {
+		return Message{}, errors.New("bad message length")
+	}
+
+	body := make([]byte, length-HEADER_LEN)
+	if err := readFull(socket, body); err != nil {
+		return Message{}, err
+	}
+
+	return UnmarshalMessage(MessageType(header[2]), body)
+}
+
+func readFull(socket *tcpstack.NormalSocket, data []byte) error {
+	for read := 0; read < len(data); {
+		n, err := socket.VRead(data[read:])
+		if err != nil {
+			return err
+		}
+		read += n
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package bgp
+
+// A BGP-inspired path-vector protocol between routers in different autonomous systems
+// Sessions run over our own TCP stack, routes carry AS paths to avoid loops, and the best route
+// for each prefix is picked by local preference and then AS path length
+
+import (
+	"fmt"
+	"ip-rip-in-peace/pkg/ipstack"
+	"ip-rip-in-peace/pkg/lnxconfig"
+	"ip-rip-in-peace/pkg/tcpstack"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const BGP_PORT = 179
+
+// How long to wait between attempts to open a session
+const CONNECT_RETRY = 2 * time.Second
+
+type PeerState string
+
+const (
+	PeerIdle        PeerState = "Idle"
+	PeerOpenSent    PeerState = "OpenSent"
+	PeerEstablished PeerState = "Established"
+)
+
+type Peer struct {
+	Address   netip.Addr
+	RemoteAS  uint32
+	LocalPref int
+	State     PeerState
+	RouterID  netip.Addr // Learned from the peer's OPEN
+
+	session    *session
+	routesIn   map[netip.Prefix]*Route   // Routes received from the peer
+	advertised map[netip.Prefix][]uint32 // AS paths we last sent to the peer
+}
+
+type Route struct {
+	Prefix    netip.Prefix
+	ASPath    []uint32
+	LocalPref int
+	From      *Peer // nil for networks we originate
+}
+
+type Speaker struct {
+	AS       uint32
+	RouterID netip.Addr
+	Peers    map[netip.Addr]*Peer
+	Best     map[netip.Prefix]*Route
+
+	ipStack  *ipstack.IPStack
+	tcpStack *tcpstack.TCPStack
+	config   *lnxconfig.IPConfig
+	mutex    sync.Mutex
+}
+
+func NewSpeaker(ipStack *ipstack.IPStack, tcpStack *tcpstack.TCPStack) *Speaker {
+	config := ipStack.IPConfig
+	speaker := &Speaker{
+		AS:       config.BgpAS,
+		Peers:    make(map[netip.Addr]*Peer),
+		Best:     make(map[netip.Prefix]*Route),
+		ipStack:  ipStack,
+		tcpStack: tcpStack,
+		config:   config,
+	}
+
+	for _, iface := range ipStack.Interfaces {
+		if !speaker.RouterID.IsValid() || iface.IPAddr.Less(speaker.RouterID) {
+			speaker.RouterID = iface.IPAddr
+		}
+	}
+
+	for _, neighbor := range config.BgpNeighbors {
+		speaker.Peers[neighbor.Addr] = &Peer{
+			Address:    neighbor.Addr,
+			RemoteAS:   neighbor.RemoteAS,
+			LocalPref:  neighbor.LocalPref,
+			State:      PeerIdle,
+			routesIn:   make(map[netip.Prefix]*Route),
+			advertised: make(map[netip.Prefix][]uint32),
+		}
+	}
+
+	return speaker
+}
+
+// Starts listening for sessions and connecting to peers
+// To avoid two sessions per pair, only the side with the lower address connects
+func (sp *Speaker) Start() {
+	sp.mutex.Lock()
+	sp.decide()
+	sp.mutex.Unlock()
+
+	ls := tcpstack.VListen(sp.tcpStack, BGP_PORT)
+	go sp.acceptLoop(ls)
+
+	for _, peer := range sp.Peers {
+		if sp.localAddressFor(peer.Address).Less(peer.Address) {
+			go sp.connectLoop(peer)
+		}
+	}
+}
+
+func (sp *Speaker) acceptLoop(ls *tcpstack.ListenSocket) {
+	for {
+		conn := ls.VAccept()
+
+		sp.mutex.Lock()
+		peer, ok := sp.Peers[conn.RemoteAddress]
+		if !ok || peer.State != PeerIdle {
+			sp.mutex.Unlock()
+			conn.VClose()
+			continue
+		}
+		sp.startSession(peer, conn)
+		sp.mutex.Unlock()
+	}
+}
+
+func (sp *Speaker) connectLoop(peer *Peer) {
+	for {
+		sp.mutex.Lock()
+		idle := peer.State == PeerIdle
+		sp.mutex.Unlock()
+
+		if idle {
+			conn := &tcpstack.NormalSocket{}
+			err := conn.VConnect(sp.tcpStack, peer.Address, BGP_PORT)
+			if err == nil {
+				sp.mutex.Lock()
+				if peer.State == PeerIdle {
+					sp.startSession(peer, conn)
+				} else {
+					go conn.VClose()
+				}
+				sp.mutex.Unlock()
+			}
+		}
+
+		time.Sleep(CONNECT_RETRY)
+	}
+}
+
+// Our address on the link shared with a neighbor
+func (sp *Speaker) localAddressFor(neighbor netip.Addr) netip.Addr {
+	for _, iface := range sp.ipStack.Interfaces {
+		if iface.Netmask.Contains(neighbor) {
+			return iface.IPAddr
+		}
+	}
+	return netip.Addr{}
+}
+
+func (p *Peer) isExternal(sp *Speaker) bool {
+	return p.RemoteAS != sp.AS
+}
+
+// Handles an UPDATE from an established peer
+// Must be called with the speaker mutex held
+func (sp *Speaker) processUpdate(peer *Peer, message Message) {
+	for _, prefix := range message.Withdrawn {
+		delete(peer.routesIn, prefix)
+	}
+
+	for _, announcement := range message.Announced {
+		// A path through our own AS would be a loop
+		if slices.Contains(announcement.ASPath, sp.AS) {
+			delete(peer.routesIn, announcement.Prefix)
+			continue
+		}
+		peer.routesIn[announcement.Prefix] = &Route{
+			Prefix:    announcement.Prefix,
+			ASPath:    announcement.ASPath,
+			LocalPref: peer.LocalPref,
+			From:      peer,
+		}
+	}
+
+	sp.decide()
+}
+
+// Returns true if a is preferred over b
+func better(a, b *Route) bool {
+	if a.LocalPref != b.LocalPref {
+		return a.LocalPref > b.LocalPref
+	}
+	if len(a.ASPath) != len(b.ASPath) {
+		return len(a.ASPath) < len(b.ASPath)
+	}
+	// Originated routes win ties, then the lowest peer address
+	if a.From == nil || b.From == nil {
+		return a.From == nil
+	}
+	return a.From.Address.Less(b.From.Address)
+}
+
+// Picks the best route for every known prefix, installs them and tells peers about changes
+// Must be called with the speaker mutex held
+func (sp *Speaker) decide() {
+	best := make(map[netip.Prefix]*Route)
+	consider := func(route *Route) {
+		if current, ok := best[route.Prefix]; !ok || better(route, current) {
+			best[route.Prefix] = route
+		}
+	}
+
+	for _, prefix := range sp.config.BgpNetworks {
+		consider(&Route{Prefix: prefix, ASPath: []uint32{}, LocalPref: 100})
+	}
+	for _, peer := range sp.Peers {
+		if peer.State != PeerEstablished {
+			continue
+		}
+		for _, route := range peer.routesIn {
+			consider(route)
+		}
+	}
+	sp.Best = best
+
+	entries := make([]ipstack.ForwardingTableEntry, 0, len(best))
+	for _, route := range best {
+		if route.From == nil {
+			continue
+		}
+		entries = append(entries, ipstack.ForwardingTableEntry{
+			DestinationPrefix: route.Prefix,
+			NextHop:           route.From.Address,
+			Interface:         sp.interfaceFor(route.From.Address),
+			Metric:            len(route.ASPath),
+			Source:            ipstack.SourceBGP,
+			LastUpdated:       time.Now(),
+		})
+	}
+	sp.ipStack.ForwardingTable.ReplaceSourceRoutes(ipstack.SourceBGP, entries)
+
+	for _, peer := range sp.Peers {
+		if peer.State == PeerEstablished {
+			sp.advertise(peer)
+		}
+	}
+}
+
+func (sp *Speaker) interfaceFor(neighbor netip.Addr) string {
+	for name, iface := range sp.ipStack.Interfaces {
+		if iface.Netmask.Contains(neighbor) {
+			return name
+		}
+	}
+	return ""
+}
+
+// The AS path we would send a peer for a route, or false if the route shouldn't be sent
+func (sp *Speaker) exportPath(peer *Peer, route *Route) ([]uint32, bool) {
+	if route.From == peer {
+		return nil, false
+	}
+	// Routes from internal peers are not passed on to other internal peers
+	if route.From != nil && !route.From.isExternal(sp) && !peer.isExternal(sp) {
+		return nil, false
+	}
+	if peer.isExternal(sp) {
+		return append([]uint32{sp.AS}, route.ASPath...), true
+	}
+	return route.ASPath, true
+}
+
+// Sends a peer the difference between what it should know and what we last told it
+// Must be called with the speaker mutex held
+func (sp *Speaker) advertise(peer *Peer) {
+	update := Message{Type: MSG_UPDATE}
+
+	for prefix := range peer.advertised {
+		route, ok := sp.Best[prefix]
+		if ok {
+			if _, export := sp.exportPath(peer, route); export {
+				continue
+			}
+		}
+		update.Withdrawn = append(update.Withdrawn, prefix)
+		delete(peer.advertised, prefix)
+	}
+
+	for prefix, route := range sp.Best {
+		path, export := sp.exportPath(peer, route)
+		if !export {
+			continue
+		}
+		if sent, ok := peer.advertised[prefix]; ok && slices.Equal(sent, path) {
+			continue
+		}
+		update.Announced = append(update.Announced, Announcement{Prefix: prefix, ASPath: path})
+		peer.advertised[prefix] = path
+	}
+
+	if len(update.Withdrawn) > 0 || len(update.Announced) > 0 {
+		peer.session.send(update)
+	}
+}
+
+// Prints the state of every configured peer
+func (sp *Speaker) PrintPeers() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	fmt.Printf("Local AS %d, router ID %s\n", sp.AS, sp.RouterID)
+	fmt.Println("Neighbor AS State RouterID Received Advertised")
+	for _, peer := range sp.sortedPeers() {
+		routerID := "-"
+		if peer.RouterID.IsValid() {
+			routerID = peer.RouterID.String()
+		}
+		fmt.Printf("%s %d %s %s %d %d\n", peer.Address, peer.RemoteAS, peer.State, routerID,
+			len(peer.routesIn), len(peer.advertised))
+	}
+}
+
+// Prints the best route for every prefix, marking originated ones as local
+func (sp *Speaker) PrintRoutes() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	prefixes := make([]netip.Prefix, 0, len(sp.Best))
+	for prefix := range sp.Best {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Addr().Less(prefixes[j].Addr()) })
+
+	fmt.Println("Prefix NextHop LocalPref ASPath")
+	for _, prefix := range prefixes {
+		route := sp.Best[prefix]
+		nextHop := "local"
+		if route.From != nil {
+			nextHop = route.From.Address.String()
+		}
+		fmt.Printf("%s %s %d %v\n", prefix, nextHop, route.LocalPref, route.ASPath)
+	}
+}
+
+func (sp *Speaker) sortedPeers() []*Peer {
+	peers := make([]*Peer, 0, len(sp.Peers))
+	for _, peer := range sp.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address.Less(peers[j].Address) })
+	return peers
+}
+
+// REPL entry point, registered as the "bgp" command
+func (sp *Speaker) ReplCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: bgp peers|routes")
+		return
+	}
+
+	switch args[1] {
+	case "peers":
+		sp.PrintPeers()
+	case "routes":
+		sp.PrintRoutes()
+	default:
+		fmt.Println("Usage: bgp peers|routes")
+	}
+}
@@ -0,0 +1,109 @@
+package ipstack
+
+// Route summarization for outgoing RIP updates
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Replaces entries covered by a configured aggregate with the aggregate itself
+// The aggregate is advertised at the best metric among its components, ignoring the ones learned from the neighbor
+func (s *IPStack) summarizeEntries(neighbor netip.Addr, entries []RIPMessageEntry) []RIPMessageEntry {
+	if len(s.IPConfig.RipAggregates) == 0 {
+		return entries
+	}
+
+	summarized := make([]RIPMessageEntry, 0, len(entries))
+	covered := make(map[netip.Prefix]bool)
+	for _, entry := range entries {
+		prefix := netip.PrefixFrom(uint32ToNetipAddr(entry.address), int(entry.mask))
+		if aggregate, ok := s.aggregateFor(prefix); ok {
+			covered[aggregate] = true
+			continue
+		}
+		summarized = append(summarized, entry)
+	}
+
+	for _, aggregate := range s.IPConfig.RipAggregates {
+		if !covered[aggregate] {
+			continue
+		}
+		summarized = append(summarized, RIPMessageEntry{
+			address: netipAddrToUint32(aggregate.Addr()),
+			mask:    uint32(aggregate.Bits()),
+			cost:    uint32(s.aggregateMetric(aggregate, neighbor)),
+		})
+	}
+
+	return summarized
+}
+
+// Returns the aggregate that covers a strictly more specific prefix, if any
+func (s *IPStack) aggregateFor(prefix netip.Prefix) (netip.Prefix, bool) {
+	for _, aggregate := range s.IPConfig.RipAggregates {
+		if aggregate.Bits() < prefix.Bits() && aggregate.Contains(prefix.Addr()) {
+			return aggregate, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Best metric among the exported component routes of an aggregate, or 16 if there are none
+// Components whose next hop is the given neighbor are skipped (split horizon)
+func (s *IPStack) aggregateMetric(aggregate netip.Prefix, neighbor netip.Addr) int {
+	s.ForwardingTable.Mutex.RLock()
+	defer s.ForwardingTable.Mutex.RUnlock()
+
+	best := 16
+	for _, entry := range s.ForwardingTable.Entries {
+		prefix := entry.DestinationPrefix
+		if prefix.Bits() <= aggregate.Bits() || !aggregate.Contains(prefix.Addr()) {
+			continue
+		}
+		if !s.shouldExport(entry) || (entry.Source == SourceRIP && entry.NextHop == neighbor) {
+			continue
+		}
+		if entry.Metric < best {
+			best = entry.Metric
+		}
+	}
+	return best
+}
+
+// Keeps a discard route installed for every active aggregate, and sends a triggered withdrawal for
+// every aggregate whose last component route went away
+// Without the discard route, traffic for a part of the aggregate no component covers would follow a
+// less specific route, often the default route back to the neighbor that sent it here, and loop
+func (s *IPStack) checkAggregates() {
+	withdrawn := make([]RIPMessageEntry, 0)
+
+	s.Mutex.Lock()
+	for _, aggregate := range s.IPConfig.RipAggregates {
+		up := s.aggregateMetric(aggregate, netip.Addr{}) < 16
+		if up && !s.aggregateUp[aggregate] {
+			s.ForwardingTable.AddRoute(ForwardingTableEntry{
+				DestinationPrefix: aggregate,
+				Metric:            0,
+				Source:            SourceDiscard,
+				LastUpdated:       time.Now(),
+			})
+		}
+		if s.aggregateUp[aggregate] && !up {
+			if entry, ok := s.ForwardingTable.Lookup(aggregate); ok && entry.Source == SourceDiscard {
+				s.ForwardingTable.RemoveRoute(aggregate)
+			}
+			withdrawn = append(withdrawn, RIPMessageEntry{
+				address: netipAddrToUint32(aggregate.Addr()),
+				mask:    uint32(aggregate.Bits()),
+				cost:    16,
+			})
+		}
+		s.aggregateUp[aggregate] = up
+	}
+	s.Mutex.Unlock()
+
+	if len(withdrawn) > 0 {
+		s.SendTriggeredUpdate(withdrawn)
+	}
+}
@@ -0,0 +1,234 @@
+package ipstack
+
+// BFD-like liveness detection: neighbors exchange small control packets every interval, and a
+// session that hears nothing for interval * multiplier goes down and takes its routes with it
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+type BFDState uint8
+
+const (
+	BFDDown BFDState = 0
+	BFDInit BFDState = 1
+	BFDUp   BFDState = 2
+)
+
+func (st BFDState) String() string {
+	switch st {
+	case BFDInit:
+		return "init"
+	case BFDUp:
+		return "up"
+	default:
+		return "down"
+	}
+}
+
+type BFDSession struct {
+	Neighbor       netip.Addr
+	State          BFDState
+	LastRx         time.Time
+	DetectTime     time.Duration // The neighbor's interval * multiplier, from its last packet
+	Flaps          int           // Number of times the session went down after being up
+	LastTransition time.Time
+}
+
+// Control packet: sender's state, detect multiplier and transmit interval in milliseconds
+type BFDPacket struct {
+	state      BFDState
+	multiplier uint8
+	intervalMs uint32
+}
+
+func MarshalBFDPacket(packet BFDPacket) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	for _, field := range []any{packet.state, packet.multiplier, packet.intervalMs} {
+		err := binary.Write(buf, binary.BigEndian, field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func UnmarshalBFDPacket(data []byte) (BFDPacket, error) {
+	buf := bytes.NewBuffer(data)
+	var packet BFDPacket
+	for _, field := range []any{&packet.state, &packet.multiplier, &packet.intervalMs} {
+		err := binary.Read(buf, binary.BigEndian, field)
+		if err != nil {
+			return BFDPacket{}, err
+		}
+	}
+	return packet, nil
+}
+
+// Handle BFD packets, following the Down -> Init -> Up three-way handshake
+func BFDHandler(packet *IPPacket, stack *IPStack) {
+	control, err := UnmarshalBFDPacket(packet.Payload)
+	if err != nil {
+		slog.Error("Error unmarshalling BFD packet", "error", err)
+		return
+	}
+
+	stack.Mutex.Lock()
+	session, ok := stack.BFDSessions[packet.SourceIP]
+	if !ok {
+		stack.Mutex.Unlock()
+		return
+	}
+
+	session.LastRx = time.Now()
+	session.DetectTime = time.Duration(control.intervalMs) * time.Millisecond * time.Duration(control.multiplier)
+
+	wentDown := false
+	switch control.state {
+	case BFDDown:
+		if session.State == BFDDown {
+			session.setState(BFDInit)
+		} else if session.State == BFDUp {
+			// The neighbor lost us
+			session.setState(BFDDown)
+			wentDown = true
+		}
+	case BFDInit:
+		if session.State != BFDUp {
+			session.setState(BFDUp)
+		}
+	case BFDUp:
+		if session.State == BFDInit {
+			session.setState(BFDUp)
+		}
+	}
+	stack.Mutex.Unlock()
+
+	if wentDown {
+		stack.neighborDown(packet.SourceIP)
+	}
+}
+
+func (session *BFDSession) setState(state BFDState) {
+	if session.State == BFDUp && state == BFDDown {
+		session.Flaps++
+	}
+	session.State = state
+	session.LastTransition = time.Now()
+}
+
+// Goroutine that sends control packets and checks detection timers
+func (s *IPStack) BFDLoop() {
+	interval := s.IPConfig.BfdInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		down := make([]netip.Addr, 0)
+		packets := make(map[netip.Addr]BFDPacket)
+
+		s.Mutex.Lock()
+		for neighbor, session := range s.BFDSessions {
+			if session.State != BFDDown && time.Since(session.LastRx) > session.DetectTime {
+				session.setState(BFDDown)
+				down = append(down, neighbor)
+			}
+			packets[neighbor] = BFDPacket{
+				state:      session.State,
+				multiplier: uint8(s.IPConfig.BfdMultiplier),
+				intervalMs: uint32(interval / time.Millisecond),
+			}
+		}
+		s.Mutex.Unlock()
+
+		for _, neighbor := range down {
+			s.neighborDown(neighbor)
+		}
+
+		for neighbor, packet := range packets {
+			data, err := MarshalBFDPacket(packet)
+			if err != nil {
+				slog.Error("Error marshalling BFD packet", "error", err)
+				continue
+			}
+			s.SendIP(neighbor, BFD_PROTOCOL, 1+1, data)
+		}
+	}
+}
+
+// Invalidates everything learned through a neighbor whose session just went down
+func (s *IPStack) neighborDown(neighbor netip.Addr) {
+	slog.Info("BFD session down", "neighbor", neighbor)
+
+	s.Mutex.Lock()
+	if ripNeighbor, ok := s.RipNeighborTable[neighbor]; ok {
+		ripNeighbor.State = RIPNeighborDown
+	}
+	s.Mutex.Unlock()
+
+	withdrawn := make([]RIPMessageEntry, 0)
+	for _, entry := range s.ForwardingTable.routesVia(neighbor, SourceRIP) {
+		s.ForwardingTable.RemoveRoute(entry.DestinationPrefix)
+		withdrawn = append(withdrawn, RIPMessageEntry{
+			address: netipAddrToUint32(entry.DestinationPrefix.Addr()),
+			mask:    uint32(entry.DestinationPrefix.Bits()),
+			cost:    16,
+		})
+	}
+
+	if len(withdrawn) > 0 {
+		s.SendTriggeredUpdate(withdrawn)
+		s.checkAggregates()
+	}
+
+	// Link-state adjacencies over the neighbor go down with it
+	if s.LinkState != nil {
+		s.LinkState.Mutex.Lock()
+		if _, ok := s.LinkState.Neighbors[neighbor]; ok {
+			delete(s.LinkState.Neighbors, neighbor)
+			s.originateLSA()
+		}
+		s.LinkState.Mutex.Unlock()
+	}
+}
+
+// Reports whether BFD considers the neighbor dead
+// Only sessions that were up count, so neighbors without BFD, or before the first handshake, are
+// still heard. A session on its way back up (Init) isn't down either
+func (s *IPStack) bfdDown(neighbor netip.Addr) bool {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	session, ok := s.BFDSessions[neighbor]
+	return ok && session.State == BFDDown && session.Flaps > 0
+}
+
+// Prints BFD session state
+func (s *IPStack) PrintBFDSessions() {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	neighbors := make([]netip.Addr, 0, len(s.BFDSessions))
+	for neighbor := range s.BFDSessions {
+		neighbors = append(neighbors, neighbor)
+	}
+	sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].Less(neighbors[j]) })
+
+	fmt.Println("Neighbor State LastRx DetectTime Flaps")
+	for _, neighbor := range neighbors {
+		session := s.BFDSessions[neighbor]
+		lastRx := "-"
+		if !session.LastRx.IsZero() {
+			lastRx = time.Since(session.LastRx).Round(time.Millisecond).String()
+		}
+		fmt.Printf("%s %s %s %s %d\n", neighbor, session.State, lastRx, session.DetectTime, session.Flaps)
+	}
+}
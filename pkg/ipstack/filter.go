@@ -0,0 +1,140 @@
+package ipstack
+
+// Prefix-list filters applied to RIP routes on import and export
+
+import (
+	"fmt"
+	"ip-rip-in-peace/pkg/lnxconfig"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Runs a route through the named prefix list and returns the resulting metric and whether it is permitted
+// An empty list name means no filter is configured, so everything is permitted
+// Lists end with an implicit deny, like most router prefix lists
+func (s *IPStack) filterRoute(listName string, prefix netip.Prefix, metric int) (int, bool) {
+	if listName == "" {
+		return metric, true
+	}
+
+	for _, entry := range s.IPConfig.PrefixLists[listName] {
+		if !prefixListMatch(entry, prefix) {
+			continue
+		}
+		if !entry.Permit {
+			return metric, false
+		}
+
+		// Leave withdrawals alone so a set-metric can't bring a dead route back
+		if metric >= 16 {
+			return metric, true
+		}
+		if entry.SetMetric != 0 {
+			metric = entry.SetMetric
+		}
+		metric += entry.MetricOffset
+		if metric > 16 {
+			metric = 16
+		} else if metric < 0 {
+			metric = 0
+		}
+		return metric, true
+	}
+
+	return metric, false
+}
+
+// Without ge/le only the exact prefix matches, otherwise any more specific prefix within the bounds
+func prefixListMatch(entry lnxconfig.PrefixListEntry, prefix netip.Prefix) bool {
+	if prefix.Bits() < entry.Prefix.Bits() || !entry.Prefix.Contains(prefix.Addr()) {
+		return false
+	}
+
+	if entry.Ge == 0 && entry.Le == 0 {
+		return prefix.Bits() == entry.Prefix.Bits()
+	}
+
+	minLen, maxLen := entry.Prefix.Bits(), 32
+	if entry.Ge != 0 {
+		minLen = entry.Ge
+	}
+	if entry.Le != 0 {
+		maxLen = entry.Le
+	}
+	return prefix.Bits() >= minLen && prefix.Bits() <= maxLen
+}
+
+// Applies the export filter for a neighbor to a set of outgoing entries
+func (s *IPStack) filterExport(neighbor netip.Addr, entries []RIPMessageEntry) []RIPMessageEntry {
+	listName := s.IPConfig.RipExportFilters[neighbor]
+	if listName == "" {
+		return entries
+	}
+
+	filtered := make([]RIPMessageEntry, 0, len(entries))
+	for _, entry := range entries {
+		prefix := netip.PrefixFrom(uint32ToNetipAddr(entry.address), int(entry.mask))
+		metric, permitted := s.filterRoute(listName, prefix, int(entry.cost))
+		if !permitted {
+			continue
+		}
+		entry.cost = uint32(metric)
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// Prints the configured prefix lists and the neighbors they are attached to
+func (s *IPStack) PrintFilters() {
+	fmt.Println("Neighbor Dir List")
+	for _, neighbor := range sortedNeighbors(s.IPConfig.RipImportFilters) {
+		fmt.Printf("%s in %s\n", neighbor, s.IPConfig.RipImportFilters[neighbor])
+	}
+	for _, neighbor := range sortedNeighbors(s.IPConfig.RipExportFilters) {
+		fmt.Printf("%s out %s\n", neighbor, s.IPConfig.RipExportFilters[neighbor])
+	}
+
+	names := make([]string, 0, len(s.IPConfig.PrefixLists))
+	for name := range s.IPConfig.PrefixLists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("prefix-list %s:\n", name)
+		for _, entry := range s.IPConfig.PrefixLists[name] {
+			fmt.Printf("  %s\n", formatPrefixListEntry(entry))
+		}
+	}
+}
+
+// Neighbors with a filter attached, in address order so the listing is the same every time
+func sortedNeighbors(filters map[netip.Addr]string) []netip.Addr {
+	neighbors := make([]netip.Addr, 0, len(filters))
+	for neighbor := range filters {
+		neighbors = append(neighbors, neighbor)
+	}
+	sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].Less(neighbors[j]) })
+	return neighbors
+}
+
+func formatPrefixListEntry(entry lnxconfig.PrefixListEntry) string {
+	parts := []string{"deny", entry.Prefix.String()}
+	if entry.Permit {
+		parts[0] = "permit"
+	}
+	if entry.Ge != 0 {
+		parts = append(parts, fmt.Sprintf("ge %d", entry.Ge))
+	}
+	if entry.Le != 0 {
+		parts = append(parts, fmt.Sprintf("le %d", entry.Le))
+	}
+	if entry.SetMetric != 0 {
+		parts = append(parts, fmt.Sprintf("set-metric %d", entry.SetMetric))
+	}
+	if entry.MetricOffset != 0 {
+		parts = append(parts, fmt.Sprintf("offset-metric %d", entry.MetricOffset))
+	}
+	return strings.Join(parts, " ")
+}
@@ -23,6 +23,9 @@ const (
 	SourceStatic    RouteSource = "STATIC"
 	SourceRIP       RouteSource = "RIP"
 	SourceLocal     RouteSource = "LOCAL"
+	SourceLS        RouteSource = "LS"
+	SourceBGP       RouteSource = "BGP"
+	SourceDiscard   RouteSource = "DISCARD" // Drops what it matches, installed for active RIP aggregates
 )
 
 type ForwardingTable struct {
@@ -70,6 +73,19 @@ func (ft *ForwardingTable) AddRoute(entry ForwardingTableEntry) {
 	ft.Entries = append(ft.Entries, entry)
 }
 
+// Overwrites the entry for the same prefix, regardless of metric
+func (ft *ForwardingTable) UpdateRoute(entry ForwardingTableEntry) {
+	ft.Mutex.Lock()
+	defer ft.Mutex.Unlock()
+
+	for i, e := range ft.Entries {
+		if e.DestinationPrefix == entry.DestinationPrefix {
+			ft.Entries[i] = entry
+			return
+		}
+	}
+}
+
 // Returns the route entry for a given prefix if it exists
 func (ft *ForwardingTable) Lookup(prefix netip.Prefix) (*ForwardingTableEntry, bool) {
 	ft.Mutex.RLock()
@@ -95,3 +111,42 @@ func (ft *ForwardingTable) RemoveRoute(prefix netip.Prefix) {
 		}
 	}
 }
+
+// Replaces every route learned from a source with a new set of routes
+// Routes for prefixes that another source already covers are skipped
+func (ft *ForwardingTable) ReplaceSourceRoutes(source RouteSource, entries []ForwardingTableEntry) {
+	ft.Mutex.Lock()
+	defer ft.Mutex.Unlock()
+
+	kept := make([]ForwardingTableEntry, 0, len(ft.Entries)+len(entries))
+	covered := make(map[netip.Prefix]bool)
+	for _, e := range ft.Entries {
+		if e.Source != source {
+			kept = append(kept, e)
+			covered[e.DestinationPrefix] = true
+		}
+	}
+
+	for _, e := range entries {
+		if !covered[e.DestinationPrefix] {
+			kept = append(kept, e)
+			covered[e.DestinationPrefix] = true
+		}
+	}
+
+	ft.Entries = kept
+}
+
+// Returns a copy of the routes from a source that go through the given next hop
+func (ft *ForwardingTable) routesVia(nextHop netip.Addr, source RouteSource) []ForwardingTableEntry {
+	ft.Mutex.RLock()
+	defer ft.Mutex.RUnlock()
+
+	routes := make([]ForwardingTableEntry, 0)
+	for _, e := range ft.Entries {
+		if e.NextHop == nextHop && e.Source == source {
+			routes = append(routes, e)
+		}
+	}
+	return routes
+}
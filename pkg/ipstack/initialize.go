@@ -23,6 +23,19 @@ func InitNode(fileName string) (*IPStack, error) {
 
 	// Create handlers
 	ipstack.Handlers = make(map[Protocol]HandlerFunc)
+	ipstack.Commands = make(map[string]CommandFunc)
+
+	ipstack.aggregateUp = make(map[netip.Prefix]bool)
+
+	ipstack.BFDSessions = make(map[netip.Addr]*BFDSession)
+	for _, neighbor := range ipconfig.BfdNeighbors {
+		ipstack.BFDSessions[neighbor] = &BFDSession{Neighbor: neighbor, State: BFDDown}
+	}
+
+	ipstack.RipNeighborTable = make(map[netip.Addr]*RIPNeighbor)
+	for _, neighbor := range ipconfig.RipNeighbors {
+		ipstack.RipNeighborTable[neighbor] = &RIPNeighbor{Address: neighbor, State: RIPNeighborDown}
+	}
 
 	ipstack.ForwardingTable = &ForwardingTable{
 		Entries: make([]ForwardingTableEntry, 0),
@@ -46,6 +59,8 @@ func InitNode(fileName string) (*IPStack, error) {
 			UDPAddr:   &udpaddr,
 			Socket:    nil,
 			Neighbors: make(map[netip.Addr]*net.UDPAddr),
+			Cost:      iface.Cost,
+			MTU:       iface.MTU,
 		}
 
 		// Create UDP socket
@@ -81,11 +96,16 @@ func InitNode(fileName string) (*IPStack, error) {
 
 	// Add static routes
 	for prefix, nextHop := range ipconfig.StaticRoutes {
+		ifname := ipstack.getInterfaceForIP(nextHop)
+		metric := 1
+		if iface, ok := ipstack.Interfaces[ifname]; ok {
+			metric = iface.Cost
+		}
 		ipstack.ForwardingTable.AddRoute(ForwardingTableEntry{
 			DestinationPrefix: prefix,
 			NextHop:           nextHop,
-			Interface:         ipstack.getInterfaceForIP(nextHop),
-			Metric:            1,
+			Interface:         ifname,
+			Metric:            metric,
 			Source:            SourceStatic,
 		})
 	}
@@ -5,8 +5,13 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+
+	ipv4header "github.com/brown-csci1680/iptcp-headers"
 )
 
+// Largest IPv4 datagram, reads use it so a neighbor with a larger MTU doesn't have its packets cut short
+const MAX_DATAGRAM_SIZE = 65535
+
 // Here, we also define the interface struct
 type Interface struct {
 	Name      string
@@ -16,6 +21,13 @@ type Interface struct {
 	Socket    *net.UDPConn
 	Neighbors map[netip.Addr]*net.UDPAddr // Neighbor IP to UDP address mapping
 	Down      bool
+	Cost      int // Routing cost of the link, added to routes learned over it
+	MTU       int // Largest IP packet the link carries, we don't fragment
+}
+
+// Largest IP payload that fits in one packet on this link
+func (i *Interface) MaxPayload() int {
+	return i.MTU - ipv4header.HeaderLen
 }
 
 func (i *Interface) SendPacket(packet *IPPacket, nextHop netip.Addr) error {
@@ -29,6 +41,10 @@ func (i *Interface) SendPacket(packet *IPPacket, nextHop netip.Addr) error {
 		return err
 	}
 
+	if len(marshalled_packet) > i.MTU {
+		return errors.New("packet exceeds interface MTU")
+	}
+
 	// Check if nextHop is in table
 	if _, ok := i.Neighbors[nextHop]; !ok {
 		return errors.New("nextHop not in neighbors table")
@@ -46,12 +62,13 @@ func (i *Interface) SendPacket(packet *IPPacket, nextHop netip.Addr) error {
 func InterfaceListen(i *Interface, stack *IPStack) {
 	// The packet handler function will likely be just one that holds on to it if it is the destination or forwards it if not
 	// Listen on interface for packets
+	// The MTU only limits what we send, reads take whatever the neighbor sent
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
 	for {
 		if i.Down {
 			continue
 		}
 
-		buffer := make([]byte, 1040)
 		n, _, err := i.Socket.ReadFromUDP(buffer)
 		if err != nil {
 			// Handle error
@@ -62,7 +79,8 @@ func InterfaceListen(i *Interface, stack *IPStack) {
 			continue
 		}
 
-		packet, err := UnmarshalPacket(buffer[:n])
+		// The packet keeps its payload, so it gets its own copy of the bytes
+		packet, err := UnmarshalPacket(append([]byte(nil), buffer[:n]...))
 		if err != nil {
 			slog.Error("Error unmarshalling packet", "Interface", i.Name, "error", err)
 		}
@@ -5,6 +5,7 @@ import (
 	"ip-rip-in-peace/pkg/lnxconfig"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	// "log/slog"
 )
 
@@ -15,21 +16,37 @@ type IPStack struct {
 	Mutex    sync.RWMutex        // Protects shared resources
 	IPConfig *lnxconfig.IPConfig // We add this in case we need to access some information like TCP or router timing parameters
 	Handlers map[Protocol]HandlerFunc
+	Commands map[string]CommandFunc // Extra REPL commands registered by other packages
+
+	aggregateUp map[netip.Prefix]bool // Aggregates that currently have at least one component route
+
+	LinkState *LinkState // Only set when running link-state routing
+
+	BFDSessions map[netip.Addr]*BFDSession // Keyed by neighbor address, protected by Mutex
+
+	RipNeighborTable map[netip.Addr]*RIPNeighbor // One entry per "rip advertise-to" neighbor, protected by Mutex
+	RipDebug         atomic.Bool                 // Toggled with "rip debug on|off"
 }
 
 type HandlerFunc func(*IPPacket, *IPStack)
 
+// Receives the REPL line split into fields, including the command itself
+type CommandFunc func([]string)
+
 func (s *IPStack) SendIP(dst netip.Addr, protocol Protocol, ttl uint8, data []byte) error {
 	// We treat it the same
-	interfaceName, _ := s.ForwardingTable.NextHop(dst)
-	if interfaceName == "" {
-		return errors.New("no route to destination")
+	nextIF, err := s.OutgoingInterface(dst)
+	if err != nil {
+		return err
 	}
 
-	nextIF := s.Interfaces[interfaceName]
+	return s.SendIPFrom(nextIF.IPAddr, dst, protocol, ttl, data)
+}
 
+// Like SendIP with a source address the caller already chose, for protocols whose payload depends on it
+func (s *IPStack) SendIPFrom(src, dst netip.Addr, protocol Protocol, ttl uint8, data []byte) error {
 	// We increment TTL by one to counter the decrement in ReceivePacket
-	packet, err := CreatePacket(nextIF.IPAddr, dst, ttl, protocol, data)
+	packet, err := CreatePacket(src, dst, ttl, protocol, data)
 	if err != nil {
 		return err
 	}
@@ -39,10 +56,23 @@ func (s *IPStack) SendIP(dst netip.Addr, protocol Protocol, ttl uint8, data []by
 	return nil
 }
 
+// Returns the interface packets to dst leave from, whose address SendIP uses as the source
+func (s *IPStack) OutgoingInterface(dst netip.Addr) (*Interface, error) {
+	interfaceName, _ := s.ForwardingTable.NextHop(dst)
+	if interfaceName == "" {
+		return nil, errors.New("no route to destination")
+	}
+	return s.Interfaces[interfaceName], nil
+}
+
 func (s *IPStack) RegisterHandler(protocol Protocol, handler HandlerFunc) {
 	s.Handlers[protocol] = handler
 }
 
+func (s *IPStack) RegisterCommand(name string, command CommandFunc) {
+	s.Commands[name] = command
+}
+
 func (s *IPStack) HandlePacket(packet *IPPacket) {
 	// Check if we have a handler for this protocol
 	handler, ok := s.Handlers[packet.Protocol]
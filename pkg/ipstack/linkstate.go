@@ -0,0 +1,431 @@
+package ipstack
+
+// OSPF-like link-state routing: hellos build adjacencies, LSAs are flooded to every router,
+// and each router runs Dijkstra over its link-state database to fill the forwarding table
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+type LSNeighborState int
+
+const (
+	LSNeighborInit LSNeighborState = 0 // We heard their hello, they haven't heard ours
+	LSNeighborFull LSNeighborState = 1 // Both sides hear each other
+)
+
+type LSNeighbor struct {
+	Address   netip.Addr // Neighbor's address on the shared link
+	RouterID  netip.Addr
+	Interface string
+	State     LSNeighborState
+	LastHello time.Time
+}
+
+// An LSA as stored in the database, with the time it was received so it can be aged
+type LSDBEntry struct {
+	LSA      LSA
+	Received time.Time
+}
+
+type LinkState struct {
+	RouterID  netip.Addr
+	Neighbors map[netip.Addr]*LSNeighbor // Keyed by the neighbor's interface address
+	LSDB      map[netip.Addr]*LSDBEntry  // Keyed by originating router ID
+	Mutex     sync.Mutex
+	seq       uint32
+}
+
+// Sets up link-state state on the stack, using the lowest interface address as the router ID
+func (s *IPStack) InitLinkState() {
+	ls := &LinkState{
+		Neighbors: make(map[netip.Addr]*LSNeighbor),
+		LSDB:      make(map[netip.Addr]*LSDBEntry),
+	}
+
+	for _, iface := range s.Interfaces {
+		if !ls.RouterID.IsValid() || iface.IPAddr.Less(ls.RouterID) {
+			ls.RouterID = iface.IPAddr
+		}
+	}
+
+	s.LinkState = ls
+
+	ls.Mutex.Lock()
+	s.originateLSA()
+	ls.Mutex.Unlock()
+}
+
+// Handle link-state packets
+func LSHandler(packet *IPPacket, stack *IPStack) {
+	message, err := UnmarshalLSMessage(packet.Payload)
+	if err != nil {
+		slog.Error("Error unmarshalling link-state message", "error", err)
+		return
+	}
+
+	ls := stack.LinkState
+	ls.Mutex.Lock()
+	defer ls.Mutex.Unlock()
+
+	switch message.msgType {
+	case LS_HELLO:
+		stack.processHello(packet.SourceIP, message.hello)
+	case LS_UPDATE:
+		stack.processLSA(packet.SourceIP, message.lsa)
+	}
+}
+
+// Goroutine that sends hellos and expires dead neighbors
+func (s *IPStack) LSHelloLoop() {
+	ticker := time.NewTicker(s.IPConfig.LsHelloInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		ls := s.LinkState
+		ls.Mutex.Lock()
+
+		changed := false
+		for addr, neighbor := range ls.Neighbors {
+			if time.Since(neighbor.LastHello) > s.IPConfig.LsDeadInterval {
+				delete(ls.Neighbors, addr)
+				changed = changed || neighbor.State == LSNeighborFull
+			}
+		}
+		if changed {
+			s.originateLSA()
+		}
+
+		hello := LSHello{
+			routerID: netipAddrToUint32(ls.RouterID),
+			seen:     make([]uint32, 0, len(ls.Neighbors)),
+		}
+		for _, neighbor := range ls.Neighbors {
+			hello.seen = append(hello.seen, netipAddrToUint32(neighbor.RouterID))
+		}
+		ls.Mutex.Unlock()
+
+		// Hosts don't handle the protocol, so it is fine to say hello to every neighbor
+		for _, neighbor := range s.IPConfig.Neighbors {
+			s.sendLSMessage(neighbor.DestAddr, LSMessage{msgType: LS_HELLO, hello: hello})
+		}
+	}
+}
+
+// Goroutine that refreshes our own LSA and removes LSAs that reached their max age
+func (s *IPStack) LSAgingLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		ls := s.LinkState
+		ls.Mutex.Lock()
+
+		changed := false
+		for origin, entry := range ls.LSDB {
+			if origin == ls.RouterID {
+				if entry.age() >= s.IPConfig.LsRefreshInterval {
+					s.originateLSA()
+				}
+				continue
+			}
+			if entry.age() >= s.IPConfig.LsMaxAge {
+				delete(ls.LSDB, origin)
+				changed = true
+			}
+		}
+		if changed {
+			s.runSPF()
+		}
+
+		ls.Mutex.Unlock()
+	}
+}
+
+// Current age of a stored LSA
+func (e *LSDBEntry) age() time.Duration {
+	return time.Duration(e.LSA.age)*time.Second + time.Since(e.Received)
+}
+
+// Must be called with the link-state mutex held
+func (s *IPStack) processHello(source netip.Addr, hello LSHello) {
+	ls := s.LinkState
+
+	neighbor, ok := ls.Neighbors[source]
+	if !ok {
+		neighbor = &LSNeighbor{
+			Address:   source,
+			Interface: s.getInterfaceForIP(source),
+			State:     LSNeighborInit,
+		}
+		ls.Neighbors[source] = neighbor
+	}
+	neighbor.RouterID = uint32ToNetipAddr(hello.routerID)
+	neighbor.LastHello = time.Now()
+
+	seesUs := false
+	for _, id := range hello.seen {
+		if uint32ToNetipAddr(id) == ls.RouterID {
+			seesUs = true
+			break
+		}
+	}
+
+	if seesUs && neighbor.State != LSNeighborFull {
+		neighbor.State = LSNeighborFull
+		s.originateLSA()
+
+		// Bring the new neighbor's database up to date
+		for _, entry := range ls.LSDB {
+			s.sendLSA(source, entry)
+		}
+	} else if !seesUs && neighbor.State == LSNeighborFull {
+		neighbor.State = LSNeighborInit
+		s.originateLSA()
+	}
+}
+
+// Must be called with the link-state mutex held
+func (s *IPStack) processLSA(source netip.Addr, lsa LSA) {
+	ls := s.LinkState
+	origin := uint32ToNetipAddr(lsa.origin)
+
+	// Only accept updates from routers we have heard a hello from
+	if _, ok := ls.Neighbors[source]; !ok {
+		return
+	}
+
+	if origin == ls.RouterID {
+		// An old copy of our own LSA from before a restart, jump past it
+		if lsa.seq >= ls.seq {
+			ls.seq = lsa.seq
+			s.originateLSA()
+		}
+		return
+	}
+
+	existing, ok := ls.LSDB[origin]
+	if ok && lsa.seq <= existing.LSA.seq {
+		return
+	}
+	if time.Duration(lsa.age)*time.Second >= s.IPConfig.LsMaxAge {
+		return
+	}
+
+	entry := &LSDBEntry{LSA: lsa, Received: time.Now()}
+	ls.LSDB[origin] = entry
+	s.floodLSA(entry, source)
+	s.runSPF()
+}
+
+// Builds a new LSA for this router, installs it and floods it
+// Must be called with the link-state mutex held
+func (s *IPStack) originateLSA() {
+	ls := s.LinkState
+	ls.seq++
+
+	lsa := LSA{
+		origin:   netipAddrToUint32(ls.RouterID),
+		seq:      ls.seq,
+		links:    make([]LSALink, 0),
+		prefixes: make([]LSAPrefix, 0),
+	}
+
+	for _, neighbor := range ls.Neighbors {
+		if neighbor.State == LSNeighborFull {
+			lsa.links = append(lsa.links, LSALink{
+				neighbor: netipAddrToUint32(neighbor.RouterID),
+				cost:     uint32(s.linkCost(neighbor.Address)),
+			})
+		}
+	}
+
+	for _, iface := range s.Interfaces {
+		if iface.Down {
+			continue
+		}
+		lsa.prefixes = append(lsa.prefixes, LSAPrefix{
+			address: netipAddrToUint32(iface.Netmask.Addr()),
+			mask:    uint32(iface.Netmask.Bits()),
+		})
+	}
+
+	entry := &LSDBEntry{LSA: lsa, Received: time.Now()}
+	ls.LSDB[ls.RouterID] = entry
+	s.floodLSA(entry, netip.Addr{})
+	s.runSPF()
+}
+
+// Sends an LSA to every full neighbor except the one it came from
+func (s *IPStack) floodLSA(entry *LSDBEntry, except netip.Addr) {
+	for addr, neighbor := range s.LinkState.Neighbors {
+		if addr != except && neighbor.State == LSNeighborFull {
+			s.sendLSA(addr, entry)
+		}
+	}
+}
+
+func (s *IPStack) sendLSA(dst netip.Addr, entry *LSDBEntry) {
+	lsa := entry.LSA
+	lsa.age = uint16(entry.age() / time.Second)
+	s.sendLSMessage(dst, LSMessage{msgType: LS_UPDATE, lsa: lsa})
+}
+
+func (s *IPStack) sendLSMessage(dst netip.Addr, message LSMessage) {
+	marshalled_message, err := MarshalLSMessage(message)
+	if err != nil {
+		slog.Error("Error marshalling link-state message", "error", err)
+		return
+	}
+
+	// Errors here just mean the link is down, which the dead interval takes care of
+	s.SendIP(dst, LS_PROTOCOL, 1+1, marshalled_message)
+}
+
+// Runs Dijkstra over the database and installs the resulting routes
+// Must be called with the link-state mutex held
+func (s *IPStack) runSPF() {
+	ls := s.LinkState
+
+	dist := map[netip.Addr]int{ls.RouterID: 0}
+	firstHop := make(map[netip.Addr]*LSNeighbor)
+	done := make(map[netip.Addr]bool)
+
+	for {
+		// Pick the closest router we haven't finished yet
+		var current netip.Addr
+		best := -1
+		for id, d := range dist {
+			if !done[id] && (best == -1 || d < best) {
+				current, best = id, d
+			}
+		}
+		if best == -1 {
+			break
+		}
+		done[current] = true
+
+		entry, ok := ls.LSDB[current]
+		if !ok {
+			continue
+		}
+
+		for _, link := range entry.LSA.links {
+			next := uint32ToNetipAddr(link.neighbor)
+			if !ls.hasLink(next, current) {
+				continue // Only use links both ends agree on
+			}
+
+			d := best + int(link.cost)
+			if old, seen := dist[next]; seen && old <= d {
+				continue
+			}
+
+			hop := firstHop[current]
+			if current == ls.RouterID {
+				hop = ls.neighborByRouterID(next)
+				if hop == nil {
+					continue
+				}
+			}
+			dist[next] = d
+			firstHop[next] = hop
+		}
+	}
+
+	routes := make([]ForwardingTableEntry, 0)
+	for id, hop := range firstHop {
+		entry, ok := ls.LSDB[id]
+		if !ok {
+			continue
+		}
+		for _, prefix := range entry.LSA.prefixes {
+			routes = append(routes, ForwardingTableEntry{
+				DestinationPrefix: netip.PrefixFrom(uint32ToNetipAddr(prefix.address), int(prefix.mask)),
+				NextHop:           hop.Address,
+				Interface:         hop.Interface,
+				Metric:            dist[id],
+				Source:            SourceLS,
+				LastUpdated:       time.Now(),
+			})
+		}
+	}
+
+	// The same prefix can be attached to several routers, keep the closest one
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Metric < routes[j].Metric })
+	s.ForwardingTable.ReplaceSourceRoutes(SourceLS, routes)
+}
+
+// Checks if a router's LSA lists a link to another router
+func (ls *LinkState) hasLink(from, to netip.Addr) bool {
+	entry, ok := ls.LSDB[from]
+	if !ok {
+		return false
+	}
+	for _, link := range entry.LSA.links {
+		if uint32ToNetipAddr(link.neighbor) == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (ls *LinkState) neighborByRouterID(id netip.Addr) *LSNeighbor {
+	for _, neighbor := range ls.Neighbors {
+		if neighbor.RouterID == id && neighbor.State == LSNeighborFull {
+			return neighbor
+		}
+	}
+	return nil
+}
+
+// Prints link-state adjacencies
+func (s *IPStack) PrintLSNeighbors() {
+	ls := s.LinkState
+	ls.Mutex.Lock()
+	defer ls.Mutex.Unlock()
+
+	fmt.Println("Iface Neighbor RouterID State LastHello")
+	for _, neighbor := range ls.Neighbors {
+		state := "init"
+		if neighbor.State == LSNeighborFull {
+			state = "full"
+		}
+		fmt.Printf("%s %s %s %s %s\n", neighbor.Interface, neighbor.Address, neighbor.RouterID, state,
+			time.Since(neighbor.LastHello).Round(time.Millisecond))
+	}
+}
+
+// Prints the link-state database
+func (s *IPStack) PrintLSDB() {
+	ls := s.LinkState
+	ls.Mutex.Lock()
+	defer ls.Mutex.Unlock()
+
+	origins := make([]netip.Addr, 0, len(ls.LSDB))
+	for origin := range ls.LSDB {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool { return origins[i].Less(origins[j]) })
+
+	fmt.Printf("Router ID %s\n", ls.RouterID)
+	for _, origin := range origins {
+		entry := ls.LSDB[origin]
+		fmt.Printf("LSA %s seq %d age %ds\n", origin, entry.LSA.seq, int(entry.age()/time.Second))
+		for _, link := range entry.LSA.links {
+			fmt.Printf("  link %s cost %d\n", uint32ToNetipAddr(link.neighbor), link.cost)
+		}
+		for _, prefix := range entry.LSA.prefixes {
+			fmt.Printf("  prefix %s\n", netip.PrefixFrom(uint32ToNetipAddr(prefix.address), int(prefix.mask)))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ipstack
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Packet formats for the link-state protocol
+// Every message starts with a type, followed by either a hello or a single LSA
+type LSMessage struct {
+	msgType LSMessageType
+	hello   LSHello
+	lsa     LSA
+}
+
+type LSMessageType uint16
+
+const (
+	LS_HELLO  LSMessageType = 1
+	LS_UPDATE LSMessageType = 2
+)
+
+// Hellos carry the router IDs we have heard from, so the other side can tell the link is two-way
+type LSHello struct {
+	routerID uint32
+	seen     []uint32
+}
+
+// A link-state advertisement describes one router's adjacencies and attached prefixes
+type LSA struct {
+	origin   uint32
+	seq      uint32
+	age      uint16 // Seconds since the LSA was originated
+	links    []LSALink
+	prefixes []LSAPrefix
+}
+
+type LSALink struct {
+	neighbor uint32 // Router ID of the adjacent router
+	cost     uint32
+}
+
+type LSAPrefix struct {
+	address uint32
+	mask    uint32
+}
+
+func MarshalLSMessage(message LSMessage) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	fields := []any{message.msgType}
+	switch message.msgType {
+	case LS_HELLO:
+		fields = append(fields, message.hello.routerID, uint16(len(message.hello.seen)), message.hello.seen)
+	case LS_UPDATE:
+		lsa := message.lsa
+		fields = append(fields, lsa.origin, lsa.seq, lsa.age, uint16(len(lsa.links)))
+		for _, link := range lsa.links {
+			fields = append(fields, link.neighbor, link.cost)
+		}
+		fields = append(fields, uint16(len(lsa.prefixes)))
+		for _, prefix := range lsa.prefixes {
+			fields = append(fields, prefix.address, prefix.mask)
+		}
+	}
+
+	for _, field := range fields {
+		err := binary.Write(buf, binary.BigEndian, field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func UnmarshalLSMessage(message []byte) (LSMessage, error) {
+	buf := bytes.NewBuffer(message)
+
+	var lsMessage LSMessage
+	var count uint16
+
+	err := binary.Read(buf, binary.BigEndian, &lsMessage.msgType)
+	if err != nil {
+		return LSMessage{}, err
+	}
+
+	switch lsMessage.msgType {
+	case LS_HELLO:
+		hello := &lsMessage.hello
+		for _, field := range []any{&hello.routerID, &count} {
+			if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+				return LSMessage{}, err
+			}
+		}
+		hello.seen = make([]uint32, count)
+		if err := binary.Read(buf, binary.BigEndian, hello.seen); err != nil {
+			return LSMessage{}, err
+		}
+	case LS_UPDATE:
+		lsa := &lsMessage.lsa
+		for _, field := range []any{&lsa.origin, &lsa.seq, &lsa.age, &count} {
+			if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+				return LSMessage{}, err
+			}
+		}
+		lsa.links = make([]LSALink, count)
+		for i := range lsa.links {
+			for _, field := range []any{&lsa.links[i].neighbor, &lsa.links[i].cost} {
+				if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+					return LSMessage{}, err
+				}
+			}
+		}
+
+		if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+			return LSMessage{}, err
+		}
+		lsa.prefixes = make([]LSAPrefix, count)
+		for i := range lsa.prefixes {
+			for _, field := range []any{&lsa.prefixes[i].address, &lsa.prefixes[i].mask} {
+				if err := binary.Read(buf, binary.BigEndian, field); err != nil {
+					return LSMessage{}, err
+				}
+			}
+		}
+	}
+
+	return lsMessage, nil
+}
@@ -23,6 +23,8 @@ const (
 	TEST_PROTOCOL Protocol = 0
 	TCP_PROTOCOL  Protocol = 6
 	RIP_PROTOCOL  Protocol = 200
+	LS_PROTOCOL   Protocol = 201
+	BFD_PROTOCOL  Protocol = 202
 )
 
 // Creates a new packet struct with the given source, destination, ttl, protocol, and payload
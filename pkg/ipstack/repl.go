@@ -18,17 +18,22 @@ func (s *IPStack) Repl() {
 
 		commands := strings.Split(line, " ")
 
+		if command, ok := s.Commands[commands[0]]; ok {
+			command(strings.Fields(line))
+			continue
+		}
+
 		switch commands[0] {
 		case "li":
 			// List interfaces
 			// In format Name / Addr/Prefix / State
-			fmt.Println("Name Addr/Prefix State")
+			fmt.Println("Name Addr/Prefix State Cost")
 			for _, iface := range s.Interfaces {
 				state := "up"
 				if iface.Down {
 					state = "down"
 				}
-				fmt.Printf("%s %s %s\n", iface.Name, iface.IPAddr, state)
+				fmt.Printf("%s %s %s %d\n", iface.Name, iface.IPAddr, state, iface.Cost)
 				// Check the netmask part, the definition of prefix says length plus one so might be off by one
 			}
 		case "ln":
@@ -58,8 +63,41 @@ func (s *IPStack) Repl() {
 					fmt.Printf("S %s %s -\n", entry.DestinationPrefix, entry.NextHop)
 					continue
 				}
+				// Discard routes for RIP aggregates have no next hop or cost
+				if entry.Source == SourceDiscard {
+					fmt.Printf("D %s DISCARD -\n", entry.DestinationPrefix)
+					continue
+				}
+				// Link-state routes are shown as O, like OSPF routes on most routers
+				if entry.Source == SourceLS {
+					fmt.Printf("O %s %s %d\n", entry.DestinationPrefix, entry.NextHop, entry.Metric)
+					continue
+				}
 				fmt.Printf("%s %s %s %d\n", string(entry.Source[0]), entry.DestinationPrefix, entry.NextHop, entry.Metric)
 			}
+		case "lf":
+			// List RIP route filters
+			s.PrintFilters()
+		case "bfd":
+			// List BFD sessions
+			s.PrintBFDSessions()
+		case "rip":
+			// RIP neighbor table, learned routes and debug logging
+			s.RIPCommand(strings.Fields(line))
+		case "lsn":
+			// List link-state neighbors
+			if s.LinkState == nil {
+				fmt.Println("Link-state routing is not enabled")
+				continue
+			}
+			s.PrintLSNeighbors()
+		case "lsdb":
+			// Dump the link-state database
+			if s.LinkState == nil {
+				fmt.Println("Link-state routing is not enabled")
+				continue
+			}
+			s.PrintLSDB()
 		case "down":
 			// Disable an interface
 			// No output expected
@@ -125,13 +163,13 @@ func (s *IPStack) ReplInput(scanner *bufio.Scanner) {
 	case "li":
 		// List interfaces
 		// In format Name / Addr/Prefix / State
-		fmt.Println("Name Addr/Prefix State")
+		fmt.Println("Name Addr/Prefix State Cost")
 		for _, iface := range s.Interfaces {
 			state := "up"
 			if iface.Down {
 				state = "down"
 			}
-			fmt.Printf("%s %s %s\n", iface.Name, iface.IPAddr, state)
+			fmt.Printf("%s %s %s %d\n", iface.Name, iface.IPAddr, state, iface.Cost)
 			// Check the netmask part, the definition of prefix says length plus one so might be off by one
 		}
 	case "ln":
@@ -161,6 +199,16 @@ func (s *IPStack) ReplInput(scanner *bufio.Scanner) {
 				fmt.Printf("S %s %s -\n", entry.DestinationPrefix, entry.NextHop)
 				continue
 			}
+			// Discard routes for RIP aggregates have no next hop or cost
+			if entry.Source == SourceDiscard {
+				fmt.Printf("D %s DISCARD -\n", entry.DestinationPrefix)
+				continue
+			}
+			// Link-state routes are shown as O, like OSPF routes on most routers
+			if entry.Source == SourceLS {
+				fmt.Printf("O %s %s %d\n", entry.DestinationPrefix, entry.NextHop, entry.Metric)
+				continue
+			}
 			fmt.Printf("%s %s %s %d\n", string(entry.Source[0]), entry.DestinationPrefix, entry.NextHop, entry.Metric)
 		}
 	case "down":
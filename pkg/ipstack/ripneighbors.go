@@ -0,0 +1,157 @@
+package ipstack
+
+// Per-neighbor RIP bookkeeping and the "rip" REPL command used to inspect it
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+type RIPNeighborState string
+
+const (
+	RIPNeighborDown RIPNeighborState = "down" // Nothing heard yet, or silent for longer than the route timeout
+	RIPNeighborUp   RIPNeighborState = "up"
+)
+
+type RIPNeighbor struct {
+	Address        netip.Addr
+	State          RIPNeighborState
+	LastUpdate     time.Time // Last valid RIP packet from the neighbor
+	RoutesReceived int       // Entries in responses from the neighbor
+	RoutesAccepted int       // Entries that passed the import filter and changed or refreshed our table
+	BadPackets     int       // Packets that couldn't be parsed
+}
+
+// Records a valid packet from a neighbor
+func (s *IPStack) ripNeighborHeard(addr netip.Addr) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	neighbor, ok := s.RipNeighborTable[addr]
+	if !ok {
+		return
+	}
+	if neighbor.State != RIPNeighborUp {
+		s.ripDebug("RIP neighbor up", "neighbor", addr)
+	}
+	neighbor.State = RIPNeighborUp
+	neighbor.LastUpdate = time.Now()
+}
+
+// Adds the result of processing one response to a neighbor's counters
+func (s *IPStack) ripNeighborCount(addr netip.Addr, received int, accepted int) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if neighbor, ok := s.RipNeighborTable[addr]; ok {
+		neighbor.RoutesReceived += received
+		neighbor.RoutesAccepted += accepted
+	}
+}
+
+func (s *IPStack) ripNeighborBadPacket(addr netip.Addr) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if neighbor, ok := s.RipNeighborTable[addr]; ok {
+		neighbor.BadPackets++
+	}
+}
+
+// Marks neighbors we haven't heard from within the timeout as down
+func (s *IPStack) ripNeighborTimeouts(timeout time.Duration) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for addr, neighbor := range s.RipNeighborTable {
+		if neighbor.State == RIPNeighborUp && time.Since(neighbor.LastUpdate) > timeout {
+			neighbor.State = RIPNeighborDown
+			s.ripDebug("RIP neighbor timed out", "neighbor", addr)
+		}
+	}
+}
+
+// Logs only while "rip debug on" is set
+func (s *IPStack) ripDebug(msg string, args ...any) {
+	if s.RipDebug.Load() {
+		slog.Info(msg, args...)
+	}
+}
+
+// Prints the neighbor table
+func (s *IPStack) PrintRIPNeighbors() {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	addrs := make([]netip.Addr, 0, len(s.RipNeighborTable))
+	for addr := range s.RipNeighborTable {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+
+	fmt.Println("Neighbor Iface State LastUpdate Received Accepted BadPackets")
+	for _, addr := range addrs {
+		neighbor := s.RipNeighborTable[addr]
+		lastUpdate := "-"
+		if !neighbor.LastUpdate.IsZero() {
+			lastUpdate = time.Since(neighbor.LastUpdate).Round(time.Millisecond).String()
+		}
+		fmt.Printf("%s %s %s %s %d %d %d\n", addr, s.getInterfaceForIP(addr), neighbor.State, lastUpdate,
+			neighbor.RoutesReceived, neighbor.RoutesAccepted, neighbor.BadPackets)
+	}
+}
+
+// Prints RIP-learned routes with the neighbor they came from and their timers
+func (s *IPStack) PrintRIPRoutes() {
+	timeout := s.IPConfig.RipTimeoutThreshold
+
+	s.ForwardingTable.Mutex.RLock()
+	routes := make([]ForwardingTableEntry, 0)
+	for _, entry := range s.ForwardingTable.Entries {
+		if entry.Source == SourceRIP {
+			routes = append(routes, entry)
+		}
+	}
+	s.ForwardingTable.Mutex.RUnlock()
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].DestinationPrefix.Addr().Less(routes[j].DestinationPrefix.Addr())
+	})
+
+	fmt.Println("Prefix LearnedFrom Iface Cost Age Expires")
+	for _, route := range routes {
+		age := time.Since(route.LastUpdated)
+		expires := max(timeout-age, 0)
+		fmt.Printf("%s %s %s %d %s %s\n", route.DestinationPrefix, route.NextHop, route.Interface, route.Metric,
+			age.Round(time.Millisecond), expires.Round(time.Millisecond))
+	}
+}
+
+// Handles "rip neighbors", "rip routes" and "rip debug on|off"
+func (s *IPStack) RIPCommand(args []string) {
+	usage := "Usage: rip neighbors|routes|debug <on|off>"
+
+	if len(args) < 2 {
+		fmt.Println(usage)
+		return
+	}
+
+	switch args[1] {
+	case "neighbors":
+		s.PrintRIPNeighbors()
+	case "routes":
+		s.PrintRIPRoutes()
+	case "debug":
+		if len(args) != 3 || (args[2] != "on" && args[2] != "off") {
+			fmt.Println(usage)
+			return
+		}
+		s.RipDebug.Store(args[2] == "on")
+	default:
+		fmt.Println(usage)
+	}
+}
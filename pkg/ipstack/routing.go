@@ -30,16 +30,35 @@ func RIPHandler(packet *IPPacket, stack *IPStack) {
 	ripMessage, err := UnmarshalRIPMessage(packet.Payload)
 	if err != nil {
 		slog.Error("Error unmarshalling RIP message", "error", err)
+		stack.ripNeighborBadPacket(packet.SourceIP)
 		return
 	}
 
+	// Only talk RIP with routers we were told to advertise to
+	if !stack.isRipNeighbor(packet.SourceIP) {
+		stack.ripDebug("Ignoring RIP packet from non-neighbor", "source", packet.SourceIP)
+		return
+	}
+
+	// Routes invalidated by a BFD session-down stay gone until the session is back, even if the
+	// neighbor's RIP packets still get through
+	if stack.bfdDown(packet.SourceIP) {
+		stack.ripDebug("Ignoring RIP packet from neighbor with BFD session down", "source", packet.SourceIP)
+		return
+	}
+
+	stack.ripNeighborHeard(packet.SourceIP)
+
 	switch ripMessage.command {
 	case RIP_REQUEST:
-		// slog.Info("Received RIP request")
+		stack.ripDebug("Received RIP request", "source", packet.SourceIP)
 		stack.SendRIPResponse(packet.SourceIP, stack.GetAllRIPEntries())
 	case RIP_RESPONSE:
-		// slog.Info("Received RIP response")
+		stack.ripDebug("Received RIP response", "source", packet.SourceIP, "num_entries", len(ripMessage.entries))
 		stack.ProcessRIPResponse(packet.SourceIP, ripMessage)
+	default:
+		stack.ripDebug("Unknown RIP command", "source", packet.SourceIP, "command", ripMessage.command)
+		stack.ripNeighborBadPacket(packet.SourceIP)
 	}
 }
 
@@ -70,6 +89,8 @@ func (s *IPStack) SendRIPRequest() {
 
 // Send RIP Response to destination
 func (s *IPStack) SendRIPResponse(dst netip.Addr, entries []RIPMessageEntry) {
+	entries = s.filterExport(dst, s.summarizeEntries(dst, entries))
+
 	response := RIPMessage{
 		command:     RIP_RESPONSE,
 		num_entries: uint16(len(entries)),
@@ -82,6 +103,7 @@ func (s *IPStack) SendRIPResponse(dst netip.Addr, entries []RIPMessageEntry) {
 		return
 	}
 
+	s.ripDebug("Sending RIP response", "destination", dst, "num_entries", len(entries))
 	err = s.SendIP(dst, RIP_PROTOCOL, 1 + 1, marshalled_message)
 	if err != nil {
 		slog.Error("Error sending RIP response", "error", err)
@@ -91,13 +113,20 @@ func (s *IPStack) SendRIPResponse(dst netip.Addr, entries []RIPMessageEntry) {
 // Process RIP Response
 func (s *IPStack) ProcessRIPResponse(sourceIP netip.Addr, ripMessage RIPMessage) {
 	changedEntries := make([]RIPMessageEntry, 0)
+	accepted := 0
 
 	// slog.Info("Processing RIP response", "num_entries", len(ripMessage.entries))
 
 	for _, entry := range ripMessage.entries {
 		destAddr := uint32ToNetipAddr(entry.address)
 		destPrefix := netip.PrefixFrom(destAddr, int(entry.mask))
-		cost := int(entry.cost) + 1
+		cost := int(entry.cost) + s.linkCost(sourceIP)
+
+		cost, permitted := s.filterRoute(s.IPConfig.RipImportFilters[sourceIP], destPrefix, cost)
+		if !permitted {
+			s.ripDebug("RIP route denied by import filter", "prefix", destPrefix, "source", sourceIP)
+			continue
+		}
 
 		// slog.Info("Processing RIP response", "destAddr", destAddr, "mask", entry.mask, "destPrefix", destPrefix, "cost", cost)
 
@@ -114,6 +143,7 @@ func (s *IPStack) ProcessRIPResponse(sourceIP netip.Addr, ripMessage RIPMessage)
 		} else {
 			oldEntry, exists := s.ForwardingTable.Lookup(destPrefix)
 			if !exists || cost < oldEntry.Metric {
+				s.ripDebug("RIP route installed", "prefix", destPrefix, "source", sourceIP, "cost", cost)
 				s.ForwardingTable.AddRoute(ForwardingTableEntry{
 					DestinationPrefix: destPrefix,
 					NextHop:           sourceIP,
@@ -127,18 +157,35 @@ func (s *IPStack) ProcessRIPResponse(sourceIP netip.Addr, ripMessage RIPMessage)
 					mask:    entry.mask,
 					cost:    uint32(cost),
 				})
-			} else if oldEntry.NextHop == sourceIP {
-				// slog.Info("Same route update received", "destPrefix", destPrefix, "cost", cost, "source", sourceIP)
-				// Update timestamp and cost, check if something else should be updated
+				accepted++
+			} else if oldEntry.Source == SourceRIP && oldEntry.NextHop == sourceIP {
+				// Refresh the route we already use, and pass a cost change on
+				if cost != oldEntry.Metric {
+					s.ripDebug("RIP route cost changed", "prefix", destPrefix, "source", sourceIP, "old", oldEntry.Metric, "new", cost)
+					changedEntries = append(changedEntries, RIPMessageEntry{
+						address: entry.address,
+						mask:    entry.mask,
+						cost:    uint32(cost),
+					})
+				}
 				oldEntry.LastUpdated = time.Now()
 				oldEntry.Metric = cost
+				s.ForwardingTable.UpdateRoute(*oldEntry)
+				accepted++
+			} else {
+				s.ripDebug("RIP route ignored, existing route is better", "prefix", destPrefix, "source", sourceIP,
+					"cost", cost, "existing", oldEntry.Metric, "existing_next_hop", oldEntry.NextHop)
 			}
 		}
 	}
 
+	s.ripNeighborCount(sourceIP, len(ripMessage.entries), accepted)
+
 	if len(changedEntries) > 0 {
 		s.SendTriggeredUpdate(changedEntries)
 	}
+
+	s.checkAggregates()
 }
 
 // Send triggered update to all neighbors
@@ -172,6 +219,15 @@ func (s *IPStack) applyPoisonReverse(entries []RIPMessageEntry, neighbor netip.A
 	return poisonedEntries
 }
 
+// Cost of the link a neighbor is reached over
+func (s *IPStack) linkCost(neighbor netip.Addr) int {
+	iface, ok := s.Interfaces[s.getInterfaceForIP(neighbor)]
+	if !ok {
+		return 1
+	}
+	return iface.Cost
+}
+
 // Get the interface name for a given IP
 func (s *IPStack) getInterfaceForIP(ip netip.Addr) string {
 	for name, iface := range s.Interfaces {
@@ -182,13 +238,19 @@ func (s *IPStack) getInterfaceForIP(ip netip.Addr) string {
 	return ""
 }
 
+// Returns the routes this router exports over RIP: learned routes, originated prefixes
+// and, if redistribution is enabled, static and local routes
 func (s *IPStack) GetAllRIPEntries() []RIPMessageEntry {
+	s.ForwardingTable.Mutex.RLock()
+	defer s.ForwardingTable.Mutex.RUnlock()
+
 	entries := make([]RIPMessageEntry, 0)
 	for _, entry := range s.ForwardingTable.Entries {
-		addr := entry.DestinationPrefix.Addr().As4()
-		ipUint32 := uint32(addr[0])<<24 | uint32(addr[1])<<16 | uint32(addr[2])<<8 | uint32(addr[3])
+		if !s.shouldExport(entry) {
+			continue
+		}
 		entries = append(entries, RIPMessageEntry{
-			address: ipUint32,
+			address: netipAddrToUint32(entry.DestinationPrefix.Addr()),
 			mask:    uint32(entry.DestinationPrefix.Bits()),
 			cost:    uint32(entry.Metric),
 		})
@@ -196,6 +258,39 @@ func (s *IPStack) GetAllRIPEntries() []RIPMessageEntry {
 	return entries
 }
 
+// Decides whether a forwarding table entry should be announced to RIP neighbors
+func (s *IPStack) shouldExport(entry ForwardingTableEntry) bool {
+	switch entry.Source {
+	case SourceRIP:
+		return true
+	case SourceLocal:
+		return s.IPConfig.RipRedistributeLocal || s.isOriginated(entry.DestinationPrefix)
+	case SourceStatic:
+		return s.IPConfig.RipRedistributeStatic || s.isOriginated(entry.DestinationPrefix)
+	}
+	return false
+}
+
+// Checks if a prefix was listed with "rip originate prefix"
+func (s *IPStack) isOriginated(prefix netip.Prefix) bool {
+	for _, p := range s.IPConfig.OriginatingPrefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if an address was listed with "rip advertise-to"
+func (s *IPStack) isRipNeighbor(addr netip.Addr) bool {
+	for _, neighbor := range s.IPConfig.RipNeighbors {
+		if neighbor == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // Convert uint32 to netip.Addr
 func uint32ToNetipAddr(ipUint32 uint32) netip.Addr {
 	ipBytes := [4]byte{
@@ -207,6 +302,12 @@ func uint32ToNetipAddr(ipUint32 uint32) netip.Addr {
 	return netip.AddrFrom4(ipBytes)
 }
 
+// Convert netip.Addr to uint32
+func netipAddrToUint32(addr netip.Addr) uint32 {
+	ipBytes := addr.As4()
+	return uint32(ipBytes[0])<<24 | uint32(ipBytes[1])<<16 | uint32(ipBytes[2])<<8 | uint32(ipBytes[3])
+}
+
 // Function to run RIP timeout check on Go routine
 func (s *IPStack) RIPTimeoutCheck(timeout time.Duration) {
 	// slog.Info("Starting RIP timeout check", "timeout", timeout)
@@ -225,5 +326,8 @@ func (s *IPStack) RIPTimeoutCheck(timeout time.Duration) {
 				}
 			}
 		}
+
+		s.ripNeighborTimeouts(timeout)
+		s.checkAggregates()
 	}
 }
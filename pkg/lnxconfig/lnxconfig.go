@@ -17,6 +17,13 @@ const (
 	RoutingTypeNone   RoutingMode = 0
 	RoutingTypeStatic RoutingMode = 1
 	RoutingTypeRIP    RoutingMode = 2
+	RoutingTypeLS     RoutingMode = 3
+)
+
+// Link MTU when an interface line doesn't set one, and the smallest IPv4 allows
+const (
+	DefaultMTU = 1400
+	MinMTU     = 68
 )
 
 /*
@@ -42,15 +49,54 @@ type IPConfig struct {
 	// Manually-added routes ("route" directive, usually just for default on hosts)
 	StaticRoutes map[netip.Prefix]netip.Addr
 
-	OriginatingPrefixes []netip.Prefix // Unused, ignore.
+	// ROUTERS ONLY:  Prefixes to announce over RIP ("rip originate prefix")
+	OriginatingPrefixes []netip.Prefix
+
+	// ROUTERS ONLY:  Also announce static/local routes that were not explicitly originated
+	RipRedistributeStatic bool
+	RipRedistributeLocal  bool
+
+	// ROUTERS ONLY:  Summary prefixes that replace their more-specific routes in RIP updates
+	RipAggregates []netip.Prefix
+
+	// ROUTERS ONLY:  Named prefix lists ("rip prefix-list") and which neighbors they
+	// filter routes from (import) or to (export)
+	PrefixLists      map[string][]PrefixListEntry
+	RipImportFilters map[netip.Addr]string
+	RipExportFilters map[netip.Addr]string
 
 	// ROUTERS ONLY:  Timing parameters for RIP updates
 	RipPeriodicUpdateRate time.Duration
 	RipTimeoutThreshold   time.Duration
 
+	// ROUTERS ONLY:  Timing parameters for link-state routing
+	LsHelloInterval   time.Duration
+	LsDeadInterval    time.Duration
+	LsRefreshInterval time.Duration
+	LsMaxAge          time.Duration
+
+	// ROUTERS ONLY:  Fast liveness detection with neighbors ("bfd neighbor")
+	BfdNeighbors  []netip.Addr
+	BfdInterval   time.Duration
+	BfdMultiplier int
+
+	// ROUTERS ONLY:  Path-vector routing between autonomous systems (disabled if BgpAS is 0)
+	BgpAS                uint32
+	BgpNeighbors         []BgpNeighborConfig
+	BgpNetworks          []netip.Prefix // Prefixes this router originates
+	BgpKeepaliveInterval time.Duration
+	BgpHoldTime          time.Duration
+
 	// HOSTS ONLY:  Timing parameters for TCP
-	TcpRtoMin time.Duration
-	TcpRtoMax time.Duration
+	TcpRtoMin     time.Duration
+	TcpRtoMax     time.Duration
+	TcpDelayedAck time.Duration // Longest an ACK for in-order data may wait, 0 acknowledges every segment
+	TcpBufferSize uint32        // Send and receive buffer size of each new connection, in bytes
+
+	// Keepalive defaults for new connections, an idle time of 0 turns keepalive off
+	TcpKeepaliveIdle     time.Duration
+	TcpKeepaliveInterval time.Duration
+	TcpKeepaliveCount    int
 }
 
 type InterfaceConfig struct {
@@ -59,6 +105,27 @@ type InterfaceConfig struct {
 	AssignedPrefix netip.Prefix
 
 	UDPAddr netip.AddrPort
+
+	Cost int // Added to the metric of routes learned over this interface
+	MTU  int // Largest IP packet sent or received on this interface
+}
+
+// One line of a prefix list.  A route matches if it falls within Prefix and its
+// length is within [Ge, Le] (a bound of 0 means unset)
+type PrefixListEntry struct {
+	Permit bool
+	Prefix netip.Prefix
+	Ge     int
+	Le     int
+
+	SetMetric    int // Replaces the metric if non-zero
+	MetricOffset int // Added to the metric
+}
+
+type BgpNeighborConfig struct {
+	Addr      netip.Addr
+	RemoteAS  uint32
+	LocalPref int // Preference for routes learned from this neighbor, higher wins
 }
 
 type NeighborConfig struct {
@@ -76,12 +143,16 @@ var LnxConfig = IPConfig{
 			AssignedIP:     netip.MustParseAddr("10.1.0.1"),
 			AssignedPrefix: netip.MustParsePrefix("10.1.0.1/24"),
 			UDPAddr:        netip.MustParseAddrPort("127.0.0.1:5000"),
+			Cost:           1,
+			MTU:            DefaultMTU,
 		},
 		{
 			Name:           "if1",
 			AssignedIP:     netip.MustParseAddr("10.10.1.1"),
 			AssignedPrefix: netip.MustParsePrefix("10.10.1.1/24"),
 			UDPAddr:        netip.MustParseAddrPort("127.0.0.1:5001"),
+			Cost:           1,
+			MTU:            DefaultMTU,
 		},
 	},
 
@@ -107,8 +178,14 @@ var LnxConfig = IPConfig{
 	RipPeriodicUpdateRate: 5 * time.Second,
 	RipTimeoutThreshold:   12 * time.Second,
 
-	TcpRtoMin: 1 * time.Millisecond,
-	TcpRtoMax: 5 * time.Second,
+	TcpRtoMin:     1 * time.Millisecond,
+	TcpRtoMax:     5 * time.Second,
+	TcpDelayedAck: 40 * time.Millisecond,
+	TcpBufferSize: 256 << 10,
+
+	TcpKeepaliveIdle:     0,
+	TcpKeepaliveInterval: 75 * time.Second,
+	TcpKeepaliveCount:    9,
 }
 
 // ******************** END PUBLIC INTERFACE *********************************************
@@ -122,6 +199,9 @@ var parseCommands = map[string]ParseFunc{
 	"routing":   parseRouting,
 	"route":     parseRoute,
 	"rip":       parseRip,
+	"ls":        parseLs,
+	"bgp":       parseBgp,
+	"bfd":       parseBfd,
 	"tcp":       parseTcp,
 }
 
@@ -136,7 +216,7 @@ func parseRip(ln int, line string, config *IPConfig) error {
 
 	switch cmd {
 	case "originate":
-		if len(ripTokens) < 2 && ripTokens[0] != "prefix" {
+		if len(ripTokens) < 2 || ripTokens[0] != "prefix" {
 			return newErrString(ln, "Usage:  rip originate prefix <prefix>")
 		}
 		ripPrefix, err := netip.ParsePrefix(ripTokens[1])
@@ -162,6 +242,46 @@ func parseRip(ln int, line string, config *IPConfig) error {
 		if err != nil {
 			return err
 		}
+	case "redistribute":
+		if len(ripTokens) < 1 {
+			return newErrString(ln, "Usage:  rip redistribute static|local")
+		}
+		switch ripTokens[0] {
+		case "static":
+			config.RipRedistributeStatic = true
+		case "local":
+			config.RipRedistributeLocal = true
+		default:
+			return newErrString(ln, "Unrecognized redistribute source %s", ripTokens[0])
+		}
+	case "aggregate":
+		if len(ripTokens) < 1 {
+			return newErrString(ln, "Usage:  rip aggregate <prefix>")
+		}
+		prefix, err := netip.ParsePrefix(ripTokens[0])
+		if err != nil {
+			return newErr(ln, err)
+		}
+		config.RipAggregates = append(config.RipAggregates, prefix.Masked())
+	case "prefix-list":
+		entryName, entry, err := parsePrefixListEntry(ln, ripTokens)
+		if err != nil {
+			return err
+		}
+		config.PrefixLists[entryName] = append(config.PrefixLists[entryName], entry)
+	case "filter":
+		if len(ripTokens) < 3 || (ripTokens[1] != "in" && ripTokens[1] != "out") {
+			return newErrString(ln, "Usage:  rip filter <neighbor IP> in|out <list name>")
+		}
+		addr, err := netip.ParseAddr(ripTokens[0])
+		if err != nil {
+			return newErr(ln, err)
+		}
+		if ripTokens[1] == "in" {
+			config.RipImportFilters[addr] = ripTokens[2]
+		} else {
+			config.RipExportFilters[addr] = ripTokens[2]
+		}
 	case "periodic-update-rate":
 		if len(ripTokens) < 1 {
 			return newErrString(ln, "Usage:  rip periodic-update-rate <milliseconds>")
@@ -187,6 +307,55 @@ func parseRip(ln int, line string, config *IPConfig) error {
 	return nil
 }
 
+func parsePrefixListEntry(ln int, tokens []string) (string, PrefixListEntry, error) {
+	usage := "Usage:  rip prefix-list <name> permit|deny <prefix> [ge <len>] [le <len>] [set-metric <n>] [offset-metric <n>]"
+	if len(tokens) < 3 || (tokens[1] != "permit" && tokens[1] != "deny") {
+		return "", PrefixListEntry{}, newErrString(ln, usage)
+	}
+
+	prefix, err := netip.ParsePrefix(tokens[2])
+	if err != nil {
+		return "", PrefixListEntry{}, newErr(ln, err)
+	}
+
+	entry := PrefixListEntry{
+		Permit: tokens[1] == "permit",
+		Prefix: prefix.Masked(),
+	}
+
+	// Remaining tokens are keyword/value pairs
+	opts := tokens[3:]
+	if len(opts)%2 != 0 {
+		return "", PrefixListEntry{}, newErrString(ln, usage)
+	}
+	for i := 0; i < len(opts); i += 2 {
+		val, err := strconv.Atoi(opts[i+1])
+		if err != nil {
+			return "", PrefixListEntry{}, newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+		}
+		switch opts[i] {
+		case "ge":
+			entry.Ge = val
+		case "le":
+			entry.Le = val
+		case "set-metric":
+			entry.SetMetric = val
+		case "offset-metric":
+			entry.MetricOffset = val
+		default:
+			return "", PrefixListEntry{}, newErrString(ln, usage)
+		}
+	}
+
+	if (entry.Ge != 0 && (entry.Ge < prefix.Bits() || entry.Ge > 32)) ||
+		(entry.Le != 0 && (entry.Le < prefix.Bits() || entry.Le > 32)) ||
+		(entry.Ge != 0 && entry.Le != 0 && entry.Ge > entry.Le) {
+		return "", PrefixListEntry{}, newErrString(ln, "Invalid ge/le bounds for %s", prefix)
+	}
+
+	return tokens[0], entry, nil
+}
+
 func addOriginatingPrefix(config *IPConfig, prefix netip.Prefix) error {
 	for _, iface := range config.Interfaces {
 		if iface.AssignedPrefix == prefix {
@@ -209,6 +378,158 @@ func addRipNeighbor(config *IPConfig, neighbor netip.Addr) error {
 	return fmt.Errorf("RIP neighbor %s is not a neighbor IP", neighbor.String())
 }
 
+func parseLs(ln int, line string, config *IPConfig) error {
+	tokens := strings.Fields(line)
+
+	if len(tokens) < 3 {
+		return newErrString(ln, "Usage:  ls <hello-interval|dead-interval|refresh-interval|max-age> <milliseconds>")
+	}
+	cmd := tokens[1]
+
+	// Timers must be positive, the hello interval drives a ticker and a zero max-age would expire every LSA
+	val, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil || val < 1 {
+		return newErrString(ln, "Invalid link-state interval %s", tokens[2])
+	}
+	interval := time.Duration(val) * time.Millisecond
+
+	switch cmd {
+	case "hello-interval":
+		config.LsHelloInterval = interval
+	case "dead-interval":
+		config.LsDeadInterval = interval
+	case "refresh-interval":
+		config.LsRefreshInterval = interval
+	case "max-age":
+		config.LsMaxAge = interval
+	default:
+		return newErrString(ln, "Unrecognized link-state command %s", cmd)
+	}
+
+	return nil
+}
+
+func parseBgp(ln int, line string, config *IPConfig) error {
+	tokens := strings.Fields(line)
+
+	if len(tokens) < 3 {
+		return newErrString(ln, "Usage:  bgp [cmd] ...")
+	}
+	cmd := tokens[1]
+	bgpTokens := tokens[2:]
+
+	switch cmd {
+	case "as":
+		val, err := strconv.ParseUint(bgpTokens[0], 10, 32)
+		if err != nil {
+			return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+		}
+		config.BgpAS = uint32(val)
+	case "neighbor":
+		usage := "Usage:  bgp neighbor <neighbor IP> remote-as <asn> [local-pref <n>]"
+		if len(bgpTokens) < 3 || bgpTokens[1] != "remote-as" {
+			return newErrString(ln, usage)
+		}
+		addr, err := netip.ParseAddr(bgpTokens[0])
+		if err != nil {
+			return newErr(ln, err)
+		}
+		remoteAS, err := strconv.ParseUint(bgpTokens[2], 10, 32)
+		if err != nil {
+			return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+		}
+		neighbor := BgpNeighborConfig{
+			Addr:      addr,
+			RemoteAS:  uint32(remoteAS),
+			LocalPref: 100,
+		}
+		if len(bgpTokens) >= 5 {
+			if bgpTokens[3] != "local-pref" {
+				return newErrString(ln, usage)
+			}
+			neighbor.LocalPref, err = strconv.Atoi(bgpTokens[4])
+			if err != nil {
+				return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+			}
+		}
+		return addBgpNeighbor(config, neighbor)
+	case "network":
+		prefix, err := netip.ParsePrefix(bgpTokens[0])
+		if err != nil {
+			return newErr(ln, err)
+		}
+		config.BgpNetworks = append(config.BgpNetworks, prefix.Masked())
+	case "keepalive":
+		val, err := strconv.ParseInt(bgpTokens[0], 10, 64)
+		if err != nil || val < 1 {
+			return newErrString(ln, "Invalid keepalive interval %s", bgpTokens[0])
+		}
+		config.BgpKeepaliveInterval = time.Duration(val) * time.Millisecond
+	case "hold-time":
+		val, err := strconv.ParseInt(bgpTokens[0], 10, 64)
+		if err != nil || val < 1 {
+			return newErrString(ln, "Invalid hold time %s", bgpTokens[0])
+		}
+		config.BgpHoldTime = time.Duration(val) * time.Millisecond
+	default:
+		return newErrString(ln, "Unrecognized BGP command %s", cmd)
+	}
+
+	return nil
+}
+
+func parseBfd(ln int, line string, config *IPConfig) error {
+	tokens := strings.Fields(line)
+
+	if len(tokens) < 3 {
+		return newErrString(ln, "Usage:  bfd <neighbor|interval|multiplier> <value>")
+	}
+	cmd := tokens[1]
+
+	switch cmd {
+	case "neighbor":
+		addr, err := netip.ParseAddr(tokens[2])
+		if err != nil {
+			return newErr(ln, err)
+		}
+		for _, neighbor := range config.Neighbors {
+			if neighbor.DestAddr == addr {
+				config.BfdNeighbors = append(config.BfdNeighbors, addr)
+				return nil
+			}
+		}
+		return fmt.Errorf("BFD neighbor %s is not a neighbor IP", addr.String())
+	case "interval":
+		val, err := strconv.ParseInt(tokens[2], 10, 64)
+		if err != nil || val < 1 {
+			return newErrString(ln, "Invalid BFD interval %s", tokens[2])
+		}
+		config.BfdInterval = time.Duration(val) * time.Millisecond
+	case "multiplier":
+		val, err := strconv.Atoi(tokens[2])
+		if err != nil || val < 1 {
+			return newErrString(ln, "Invalid detect multiplier %s", tokens[2])
+		}
+		config.BfdMultiplier = val
+	default:
+		return newErrString(ln, "Unrecognized BFD command %s", cmd)
+	}
+
+	return nil
+}
+
+// BGP sessions only run between directly connected routers
+func addBgpNeighbor(config *IPConfig, neighbor BgpNeighborConfig) error {
+	for _, iface := range config.Neighbors {
+		if iface.DestAddr == neighbor.Addr {
+			config.BgpNeighbors = append(config.BgpNeighbors, neighbor)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("BGP neighbor %s is not a neighbor IP", neighbor.Addr.String())
+}
+
 func parseTcp(ln int, line string, config *IPConfig) error {
 	tokens := strings.Fields(line)
 
@@ -237,6 +558,53 @@ func parseTcp(ln int, line string, config *IPConfig) error {
 			return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
 		}
 		config.TcpRtoMax = time.Duration(val) * time.Microsecond
+	case "delayed-ack":
+		if len(argTokens) < 1 {
+			return newErrString(ln, "Usage:  tcp delayed-ack <milliseconds>")
+		}
+		val, err := strconv.ParseInt(argTokens[0], 10, 64)
+		if err != nil {
+			return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+		}
+		// RFC 1122 caps the delay at half a second
+		if val < 0 || val > 500 {
+			return newErrString(ln, "Delayed ACK timeout must be between 0 and 500 ms")
+		}
+		config.TcpDelayedAck = time.Duration(val) * time.Millisecond
+	case "buffer-size":
+		if len(argTokens) < 1 {
+			return newErrString(ln, "Usage:  tcp buffer-size <bytes>")
+		}
+		val, err := strconv.ParseUint(argTokens[0], 10, 32)
+		if err != nil {
+			return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+		}
+		// Big enough for a full segment on any link, and small enough to advertise with a window scale of 14
+		if val < 16<<10 || val > 1<<30 {
+			return newErrString(ln, "Buffer size must be between 16 KB and 1 GB")
+		}
+		config.TcpBufferSize = uint32(val)
+	case "keepalive":
+		if len(argTokens) < 3 {
+			return newErrString(ln, "Usage:  tcp keepalive <idle seconds> <interval seconds> <count>")
+		}
+		vals := make([]int64, 3)
+		for i := range vals {
+			val, err := strconv.ParseInt(argTokens[i], 10, 64)
+			if err != nil {
+				return newErrString(ln, fmt.Sprintf("Error parsing integer value: %s", err))
+			}
+			if val < 0 {
+				return newErrString(ln, "Keepalive values must not be negative")
+			}
+			vals[i] = val
+		}
+		if vals[0] > 0 && (vals[1] == 0 || vals[2] == 0) {
+			return newErrString(ln, "Keepalive interval and count must be positive")
+		}
+		config.TcpKeepaliveIdle = time.Duration(vals[0]) * time.Second
+		config.TcpKeepaliveInterval = time.Duration(vals[1]) * time.Second
+		config.TcpKeepaliveCount = int(vals[2])
 	default:
 		return newErrString(ln, "Unrecognized RIP command %s", cmd)
 	}
@@ -257,6 +625,8 @@ func parseRouting(ln int, line string, config *IPConfig) error {
 		config.RoutingMode = RoutingTypeStatic
 	case "rip":
 		config.RoutingMode = RoutingTypeRIP
+	case "ls":
+		config.RoutingMode = RoutingTypeLS
 	default:
 		return newErrString(ln, "Invalid routing type:  %s", rt)
 	}
@@ -296,7 +666,7 @@ func parseRoute(ln int, line string, config *IPConfig) error {
 func parseInterface(ln int, line string, config *IPConfig) error {
 	var sName, sPrefix, sBindAddr string
 
-	format := "interface <name> <prefix> <bindAddr>"
+	format := "interface <name> <prefix> <bindAddr> [cost <n>] [mtu <n>]"
 
 	r := strings.NewReader(line)
 	n, err := fmt.Fscanf(r, "interface %s %s %s",
@@ -329,6 +699,30 @@ func parseInterface(ln int, line string, config *IPConfig) error {
 		AssignedIP:     addr,
 		AssignedPrefix: prefix,
 		UDPAddr:        addrPort,
+		Cost:           1,
+		MTU:            DefaultMTU,
+	}
+
+	// Optional cost and MTU in any order, anything after a # is a comment
+	tokens := strings.Fields(strings.SplitN(line, "#", 2)[0])
+	if len(tokens)%2 != 0 {
+		return newErrString(ln, "interface directive must have format:  %s", format)
+	}
+	for i := 4; i < len(tokens); i += 2 {
+		switch tokens[i] {
+		case "cost":
+			iface.Cost, err = strconv.Atoi(tokens[i+1])
+			if err != nil || iface.Cost < 1 || iface.Cost > 15 {
+				return newErrString(ln, "Interface cost must be between 1 and 15")
+			}
+		case "mtu":
+			iface.MTU, err = strconv.Atoi(tokens[i+1])
+			if err != nil || iface.MTU < MinMTU || iface.MTU > 65535 {
+				return newErrString(ln, "Interface MTU must be between %d and 65535", MinMTU)
+			}
+		default:
+			return newErrString(ln, "interface directive must have format:  %s", format)
+		}
 	}
 
 	config.Interfaces = append(config.Interfaces, iface)
@@ -397,12 +791,33 @@ func ParseConfig(configFile string) (*IPConfig, error) {
 		RipNeighbors:        make([]netip.Addr, 0),
 		StaticRoutes:        make(map[netip.Prefix]netip.Addr, 0),
 		OriginatingPrefixes: make([]netip.Prefix, 0, 1),
+		RipAggregates:       make([]netip.Prefix, 0),
+		PrefixLists:         make(map[string][]PrefixListEntry),
+		RipImportFilters:    make(map[netip.Addr]string),
+		RipExportFilters:    make(map[netip.Addr]string),
 
 		RipPeriodicUpdateRate: 5 * time.Second,
 		RipTimeoutThreshold:   12 * time.Second,
 
-		TcpRtoMin: 1 * time.Millisecond,
-		TcpRtoMax: 5 * time.Second,
+		LsHelloInterval:   1 * time.Second,
+		LsDeadInterval:    4 * time.Second,
+		LsRefreshInterval: 30 * time.Second,
+		LsMaxAge:          60 * time.Second,
+
+		BfdInterval:   300 * time.Millisecond,
+		BfdMultiplier: 3,
+
+		BgpKeepaliveInterval: 1 * time.Second,
+		BgpHoldTime:          3 * time.Second,
+
+		TcpRtoMin:     1 * time.Millisecond,
+		TcpRtoMax:     5 * time.Second,
+		TcpDelayedAck: 40 * time.Millisecond,
+		TcpBufferSize: 256 << 10,
+
+		TcpKeepaliveIdle:     0,
+		TcpKeepaliveInterval: 75 * time.Second,
+		TcpKeepaliveCount:    9,
 	}
 
 	scanner := bufio.NewScanner(fd)
@@ -433,5 +848,14 @@ func ParseConfig(configFile string) (*IPConfig, error) {
 		}
 	}
 
+	// Filters may reference lists declared further down, so check them at the end
+	for _, filters := range []map[netip.Addr]string{config.RipImportFilters, config.RipExportFilters} {
+		for neighbor, name := range filters {
+			if _, ok := config.PrefixLists[name]; !ok {
+				return nil, fmt.Errorf("filter for %s uses undefined prefix list %s", neighbor, name)
+			}
+		}
+	}
+
 	return config, nil
 }
@@ -0,0 +1,67 @@
+package tcpstack
+
+// Segment acceptability (RFC 9293 section 3.10.7.4)
+// Once the connection is synchronized, a segment is only processed if part of it falls inside the
+// receive window [RCV.NXT, RCV.NXT+RCV.WND). Whatever lies outside is trimmed off, and since the
+// window is the free space in rcv.buf, everything we accept fits in the buffer
+
+// States in which both sides know each other's sequence numbers
+// SYN_RECEIVED is left out, the SYN-ACK of a simultaneous open repeats the sequence number of the SYN
+func synchronized(state TCPState) bool {
+	switch state {
+	case TCP_ESTABLISHED, TCP_FIN_WAIT_1, TCP_FIN_WAIT_2, TCP_CLOSE_WAIT, TCP_CLOSING, TCP_LAST_ACK, TCP_TIME_WAIT:
+		return true
+	}
+	return false
+}
+
+// Sequence space the segment takes up, SYN and FIN count as one byte each
+func segmentLength(header *TCPHeader, payload []byte) uint32 {
+	length := uint32(len(payload))
+	if header.Flags&TCP_SYN != 0 {
+		length++
+	}
+	if header.Flags&TCP_FIN != 0 {
+		length++
+	}
+	return length
+}
+
+// Reports whether any of the segment falls inside the receive window
+func (socket *NormalSocket) acceptable(header *TCPHeader, payload []byte) bool {
+	length := segmentLength(header, payload)
+	wnd := socket.rcv.WND
+
+	if wnd == 0 {
+		// Nothing fits, but a segment right at RCV.NXT still carries a usable ACK and window,
+		// trimToWindow removes its data
+		return header.SeqNum == socket.rcv.NXT
+	}
+	if length == 0 {
+		return header.SeqNum.InWindow(socket.rcv.NXT, wnd)
+	}
+	return header.SeqNum.InWindow(socket.rcv.NXT, wnd) || header.SeqNum.Add(length-1).InWindow(socket.rcv.NXT, wnd)
+}
+
+// Cuts off the bytes before RCV.NXT, which we already have, and those past the window, which we have
+// no room for. Returns the payload that is left and whether anything was cut
+// A FIN after data that didn't fit is cut as well, the peer sends both again
+func (socket *NormalSocket) trimToWindow(header *TCPHeader, payload []byte) ([]byte, bool) {
+	trimmed := false
+
+	if header.SeqNum.LT(socket.rcv.NXT) {
+		cut := min(int(socket.rcv.NXT.Sub(header.SeqNum)), len(payload))
+		payload = payload[cut:]
+		header.SeqNum = header.SeqNum.Add(uint32(cut))
+		trimmed = true
+	}
+
+	room := socket.rcv.WND - header.SeqNum.Sub(socket.rcv.NXT)
+	if uint32(len(payload)) > room {
+		payload = payload[:room]
+		header.Flags &^= TCP_FIN
+		trimmed = true
+	}
+
+	return payload, trimmed
+}
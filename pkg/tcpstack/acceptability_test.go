@@ -0,0 +1,139 @@
+package tcpstack
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSegmentAcceptability(t *testing.T) {
+	tests := []struct {
+		name    string
+		nxt     SequenceNumber
+		wnd     uint32
+		seq     SequenceNumber
+		length  int  // Payload bytes
+		fin     bool // Segment carries a FIN
+		accept  bool
+		wantSeq SequenceNumber // What is left after trimming, when accepted
+		wantLen int
+		wantFIN bool
+		trimmed bool
+	}{
+		// The four cases of RFC 9293 section 3.10.7.4
+		{name: "empty, zero window, at RCV.NXT", nxt: 1000, wnd: 0, seq: 1000, accept: true, wantSeq: 1000},
+		{name: "empty, zero window, past RCV.NXT", nxt: 1000, wnd: 0, seq: 1001},
+		{name: "empty, open window, inside", nxt: 1000, wnd: 100, seq: 1099, accept: true, wantSeq: 1099},
+		{name: "empty, open window, at the right edge", nxt: 1000, wnd: 100, seq: 1100},
+		{name: "empty, open window, before RCV.NXT", nxt: 1000, wnd: 100, seq: 999},
+		{name: "data, zero window, at RCV.NXT keeps only the ACK", nxt: 1000, wnd: 0, seq: 1000, length: 10,
+			accept: true, wantSeq: 1000, wantLen: 0, trimmed: true},
+		{name: "data, zero window, past RCV.NXT", nxt: 1000, wnd: 0, seq: 1005, length: 10},
+		{name: "data, open window, inside", nxt: 1000, wnd: 100, seq: 1010, length: 10,
+			accept: true, wantSeq: 1010, wantLen: 10},
+		{name: "data, open window, past the right edge", nxt: 1000, wnd: 100, seq: 1100, length: 10},
+
+		// Old duplicates
+		{name: "old duplicate", nxt: 1000, wnd: 100, seq: 900, length: 50},
+		{name: "old duplicate ending just before RCV.NXT", nxt: 1000, wnd: 100, seq: 990, length: 10},
+		{name: "old duplicate FIN", nxt: 1000, wnd: 100, seq: 999, fin: true},
+		{name: "partly old", nxt: 1000, wnd: 100, seq: 990, length: 20,
+			accept: true, wantSeq: 1000, wantLen: 10, trimmed: true},
+
+		// Segments running past the window
+		{name: "past the window", nxt: 1000, wnd: 100, seq: 1050, length: 100,
+			accept: true, wantSeq: 1050, wantLen: 50, trimmed: true},
+		{name: "past the window loses its FIN", nxt: 1000, wnd: 100, seq: 1050, length: 100, fin: true,
+			accept: true, wantSeq: 1050, wantLen: 50, trimmed: true},
+		{name: "spanning the window with neither end inside", nxt: 1000, wnd: 100, seq: 950, length: 200},
+		{name: "FIN after data that fits", nxt: 1000, wnd: 100, seq: 1050, length: 50, fin: true,
+			accept: true, wantSeq: 1050, wantLen: 50, wantFIN: true},
+
+		// The window wrapping past 2^32
+		{name: "partly old across the wrap", nxt: 0xFFFFFFF0, wnd: 100, seq: 0xFFFFFFE0, length: 32,
+			accept: true, wantSeq: 0xFFFFFFF0, wantLen: 16, trimmed: true},
+		{name: "inside a window that wraps", nxt: 0xFFFFFFF0, wnd: 100, seq: 0x10, length: 10,
+			accept: true, wantSeq: 0x10, wantLen: 10},
+		{name: "past a window that wraps", nxt: 0xFFFFFFF0, wnd: 100, seq: 0x50, length: 10,
+			accept: true, wantSeq: 0x50, wantLen: 4, trimmed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := &NormalSocket{rcv: RCV{NXT: test.nxt, WND: test.wnd}}
+			header := &TCPHeader{SeqNum: test.seq, Flags: TCP_ACK}
+			if test.fin {
+				header.Flags |= TCP_FIN
+			}
+			payload := pattern(test.length)
+
+			if got := socket.acceptable(header, payload); got != test.accept {
+				t.Fatalf("acceptable = %v, want %v", got, test.accept)
+			}
+			if !test.accept {
+				return
+			}
+
+			got, trimmed := socket.trimToWindow(header, payload)
+			if header.SeqNum != test.wantSeq || len(got) != test.wantLen || trimmed != test.trimmed {
+				t.Errorf("trimmed to seq %#x and %d bytes (trimmed %v), want seq %#x and %d bytes (trimmed %v)",
+					header.SeqNum, len(got), trimmed, test.wantSeq, test.wantLen, test.trimmed)
+			}
+			if fin := header.Flags&TCP_FIN != 0; fin != test.wantFIN {
+				t.Errorf("FIN = %v after trimming, want %v", fin, test.wantFIN)
+			}
+
+			// What is left is the part of the original payload at its new sequence number
+			offset := int(header.SeqNum.Sub(test.seq))
+			if len(got) > 0 && !bytes.Equal(got, payload[offset:offset+len(got)]) {
+				t.Errorf("trimmed payload isn't the bytes starting at seq %#x", header.SeqNum)
+			}
+		})
+	}
+}
+
+// A FIN with a gap in front of it waits for the gap to fill
+func TestFINBeforeMissingData(t *testing.T) {
+	socket := &NormalSocket{rcv: RCV{NXT: 1000, WND: 100}}
+	entry := &TCPTableEntry{State: TCP_ESTABLISHED, SocketStruct: socket}
+
+	handleFIN(&TCPStack{}, entry, &TCPHeader{SeqNum: 1005, Flags: TCP_FIN | TCP_ACK}, nil)
+	if entry.State != TCP_ESTABLISHED || socket.rcv.NXT != 1000 {
+		t.Fatalf("FIN past a gap moved the connection to state %v with RCV.NXT %d", entry.State, socket.rcv.NXT)
+	}
+}
+
+// The same over a link that loses the data, so the FIN gets there first and the data is retransmitted
+func TestFINOvertakesLostData(t *testing.T) {
+	var once sync.Once
+	drop := func(header *TCPHeader, payload []byte) bool {
+		lost := false
+		if len(payload) > 0 {
+			once.Do(func() { lost = true })
+		}
+		return lost
+	}
+	a, b := newTestPair(t, &testLink{delay: 5 * time.Millisecond, drop: drop})
+	client, server := connectPair(t, a, b, 80)
+
+	if err := client.VWrite([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	states := watchStates(b, server.LocalPort, server.RemoteAddress, server.RemotePort, TCP_CLOSE_WAIT)
+	if len(states) == 0 || states[len(states)-1] != TCP_CLOSE_WAIT {
+		t.Fatalf("server never took the FIN, states %v", states)
+	}
+	got := make([]byte, server.rcv.buf.Length())
+	server.rcv.buf.TryRead(got)
+	if string(got) != "hello" {
+		t.Fatalf("server closed with %q received, want %q", got, "hello")
+	}
+	if locked(client, func() int { return client.snd.retransmitted }) == 0 {
+		t.Fatal("the lost data was never retransmitted")
+	}
+}
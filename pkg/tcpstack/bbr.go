@@ -0,0 +1,244 @@
+package tcpstack
+
+import "time"
+
+// BBR-style congestion control: instead of reacting to loss, build a model of the path from the
+// bottleneck bandwidth (the highest recent delivery rate) and the minimum RTT, pace segments at
+// about the bottleneck rate and keep roughly one bandwidth-delay product in flight
+
+type BBRMode int
+
+const (
+	BBRStartup BBRMode = iota
+	BBRDrain
+	BBRProbeBW
+	BBRProbeRTT
+)
+
+func (m BBRMode) String() string {
+	switch m {
+	case BBRStartup:
+		return "startup"
+	case BBRDrain:
+		return "drain"
+	case BBRProbeBW:
+		return "probe_bw"
+	default:
+		return "probe_rtt"
+	}
+}
+
+const (
+	BBR_HIGH_GAIN         = 2.885 // 2/ln(2), doubles the sending rate every round in startup
+	BBR_CWND_GAIN         = 2.0
+	BBR_BW_WINDOW_ROUNDS  = 10               // Rounds the bandwidth max filter remembers
+	BBR_MIN_RTT_WINDOW    = 10 * time.Second // How long a min RTT sample stays valid
+	BBR_PROBE_RTT_TIME    = 200 * time.Millisecond
+	BBR_MIN_CWND_SEGMENTS = 4
+	BBR_FULL_BW_ROUNDS    = 3    // Rounds without growth before the pipe counts as full
+	BBR_FULL_BW_GROWTH    = 1.25 // Growth that counts as still filling the pipe
+)
+
+// ProbeBW cycles through these pacing gains, one per min RTT: probe for more bandwidth,
+// drain the queue that probing built, then cruise
+var bbrPacingGainCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type BBR struct {
+	Mode BBRMode
+
+	// Model
+	bwSamples    [BBR_BW_WINDOW_ROUNDS]float64 // Highest delivery rate seen in each recent round
+	minRTT       time.Duration
+	minRTTStamp  time.Time
+	pacingGain   float64
+	cwndGain     float64
+	cycleIndex   int
+	cycleStamp   time.Time
+	probeRTTDone time.Time
+	priorCwnd    uint32
+
+	// Round counting, a round ends when a packet sent after the previous round ended is acknowledged
+	roundCount         uint64
+	nextRoundDelivered uint64
+
+	// Startup exit
+	fullBW      float64
+	fullBWCount int
+	filledPipe  bool
+}
+
+func (b *BBR) Name() string {
+	return "bbr"
+}
+
+func (b *BBR) Init(snd *SND) {
+	*b = BBR{}
+	snd.cwnd = initialWindow(snd)
+	snd.ssthresh = uint32(snd.buf.Capacity())
+	b.enterStartup()
+}
+
+// Smallest cwnd BBR uses, enough to keep ACKs flowing while probing the min RTT
+func bbrMinCwnd(snd *SND) uint32 {
+	return BBR_MIN_CWND_SEGMENTS * snd.MSS
+}
+
+func (b *BBR) enterStartup() {
+	b.Mode = BBRStartup
+	b.pacingGain = BBR_HIGH_GAIN
+	b.cwndGain = BBR_HIGH_GAIN
+}
+
+// Bottleneck bandwidth estimate in bytes per second
+func (b *BBR) BtlBw() float64 {
+	best := 0.0
+	for _, bw := range b.bwSamples {
+		best = max(best, bw)
+	}
+	return best
+}
+
+// Bandwidth-delay product in bytes, 0 until both halves of the model have a sample
+func (b *BBR) bdp() float64 {
+	return b.BtlBw() * b.minRTT.Seconds()
+}
+
+func (b *BBR) OnAck(snd *SND, sample AckSample) {
+	roundStart := false
+	if sample.PriorDelivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = snd.delivered
+		b.roundCount++
+		b.bwSamples[b.roundCount%BBR_BW_WINDOW_ROUNDS] = 0
+		roundStart = true
+	}
+
+	slot := &b.bwSamples[b.roundCount%BBR_BW_WINDOW_ROUNDS]
+	*slot = max(*slot, sample.DeliveryRate)
+
+	if sample.RTT > 0 && (b.minRTT == 0 || sample.RTT <= b.minRTT || sample.Time.Sub(b.minRTTStamp) > BBR_MIN_RTT_WINDOW) {
+		b.minRTT = sample.RTT
+		b.minRTTStamp = sample.Time
+	}
+
+	if roundStart && !b.filledPipe {
+		b.checkFullPipe()
+	}
+
+	switch b.Mode {
+	case BBRStartup:
+		if b.filledPipe {
+			b.Mode = BBRDrain
+			b.pacingGain = 1 / BBR_HIGH_GAIN
+			b.cwndGain = BBR_HIGH_GAIN
+		}
+	case BBRDrain:
+		if float64(sample.InFlight) <= b.bdp() {
+			b.enterProbeBW(sample.Time)
+		}
+	case BBRProbeBW:
+		if b.minRTT > 0 && sample.Time.Sub(b.cycleStamp) > b.minRTT {
+			b.cycleIndex = (b.cycleIndex + 1) % len(bbrPacingGainCycle)
+			b.cycleStamp = sample.Time
+			b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+		}
+	case BBRProbeRTT:
+		if b.probeRTTDone.IsZero() && sample.InFlight <= bbrMinCwnd(snd) {
+			b.probeRTTDone = sample.Time.Add(BBR_PROBE_RTT_TIME)
+		}
+		if !b.probeRTTDone.IsZero() && sample.Time.After(b.probeRTTDone) {
+			b.minRTTStamp = sample.Time
+			snd.cwnd = max(snd.cwnd, b.priorCwnd)
+			if b.filledPipe {
+				b.enterProbeBW(sample.Time)
+			} else {
+				b.enterStartup()
+			}
+		}
+	}
+
+	// Without a fresh min RTT the model may be stale, so briefly drain the queue to measure it again
+	if b.Mode != BBRProbeRTT && b.minRTT > 0 && sample.Time.Sub(b.minRTTStamp) > BBR_MIN_RTT_WINDOW {
+		b.Mode = BBRProbeRTT
+		b.pacingGain = 1
+		b.cwndGain = 1
+		b.priorCwnd = snd.cwnd
+		b.probeRTTDone = time.Time{}
+	}
+
+	b.setPacingRate(snd)
+	b.setCwnd(snd, sample)
+}
+
+// The pipe is full once the bandwidth estimate stops growing by 25% per round for three rounds
+func (b *BBR) checkFullPipe() {
+	if b.BtlBw() >= b.fullBW*BBR_FULL_BW_GROWTH {
+		b.fullBW = b.BtlBw()
+		b.fullBWCount = 0
+		return
+	}
+	b.fullBWCount++
+	if b.fullBWCount >= BBR_FULL_BW_ROUNDS {
+		b.filledPipe = true
+	}
+}
+
+func (b *BBR) enterProbeBW(now time.Time) {
+	b.Mode = BBRProbeBW
+	b.cwndGain = BBR_CWND_GAIN
+	// Start at an arbitrary phase, other than the draining one
+	b.cycleIndex = (int(b.roundCount)%(len(bbrPacingGainCycle)-1) + 2) % len(bbrPacingGainCycle)
+	b.cycleStamp = now
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+}
+
+func (b *BBR) setPacingRate(snd *SND) {
+	bw := b.BtlBw()
+	if bw == 0 {
+		// No sample yet, leave the initial window unpaced
+		return
+	}
+	rate := b.pacingGain * bw
+	// Until the pipe is full, never slow down below what we already measured
+	if b.filledPipe || rate > snd.pacingRate {
+		snd.pacingRate = rate
+	}
+}
+
+func (b *BBR) setCwnd(snd *SND, sample AckSample) {
+	if b.Mode == BBRProbeRTT {
+		snd.cwnd = bbrMinCwnd(snd)
+		return
+	}
+
+	bdp := b.bdp()
+	if bdp == 0 {
+		// No model yet, grow like slow start
+		snd.cwnd += sample.Acked
+		return
+	}
+
+	target := uint32(b.cwndGain * bdp)
+	if b.filledPipe {
+		snd.cwnd = uint32(min(int(snd.cwnd+sample.Acked), int(target)))
+	} else if snd.cwnd < target {
+		snd.cwnd += sample.Acked
+	}
+	snd.cwnd = max(snd.cwnd, bbrMinCwnd(snd))
+}
+
+func (b *BBR) OnDupAck(snd *SND) {
+	// Loss doesn't drive the model
+}
+
+func (b *BBR) OnLoss(snd *SND) {
+	// Loss doesn't drive the model, the next ACK resizes cwnd from it
+}
+
+func (b *BBR) OnExitRecovery(snd *SND) {
+	// The window never left the model during recovery
+}
+
+func (b *BBR) OnRTO(snd *SND) {
+	// Everything in flight may be lost, so restart from one segment until ACKs rebuild the window
+	snd.cwnd = snd.MSS
+}
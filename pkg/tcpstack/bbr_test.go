@@ -0,0 +1,43 @@
+package tcpstack
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// BBR spreads segments out with the pacing timer. Writes still deliver everything, and a close right
+// after a write waits for the paced data before its FIN
+func TestBBRPacedTransfer(t *testing.T) {
+	a, b := newTestPair(t, &testLink{delay: 5 * time.Millisecond})
+	if err := a.tcp.SetDefaultCongestionControl("bbr"); err != nil {
+		t.Fatal(err)
+	}
+	client, server := connectPair(t, a, b, 80)
+
+	data := pattern(512 * 1024)
+	if got := transfer(t, client, server, data); !bytes.Equal(got, data) {
+		t.Fatalf("server received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	if rate := locked(client, func() float64 { return client.snd.pacingRate }); rate == 0 {
+		t.Fatal("BBR never set a pacing rate")
+	}
+
+	tail := pattern(64 * 1024)
+	if err := client.VWrite(tail); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	states := watchStates(b, server.LocalPort, server.RemoteAddress, server.RemotePort, TCP_CLOSE_WAIT)
+	if len(states) == 0 || states[len(states)-1] != TCP_CLOSE_WAIT {
+		t.Fatalf("server never took the FIN, states %v", states)
+	}
+	got := make([]byte, server.rcv.buf.Length())
+	server.rcv.buf.TryRead(got)
+	if !bytes.Equal(got, tail) {
+		t.Fatalf("server closed with %d bytes received, want the %d written before the close", len(got), len(tail))
+	}
+}
@@ -0,0 +1,291 @@
+package tcpstack
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Congestion control decides how much unacknowledged data a connection may have in flight
+// The send path is limited by the smaller of snd.cwnd and the peer's window, and the algorithm
+// adjusts cwnd and ssthresh as ACKs, duplicate ACKs, losses and timeouts are observed
+type CongestionControl interface {
+	Name() string
+	// Sets the initial cwnd and ssthresh for a new connection
+	Init(snd *SND)
+	// New data was acknowledged
+	OnAck(snd *SND, sample AckSample)
+	// An ACK arrived that didn't acknowledge anything new while data was in flight
+	OnDupAck(snd *SND)
+	// A segment was detected as lost without a timeout, fast recovery starts right after
+	OnLoss(snd *SND)
+	// Everything outstanding when fast recovery started has been acknowledged
+	OnExitRecovery(snd *SND)
+	// The retransmission timer expired
+	OnRTO(snd *SND)
+}
+
+// What a single ACK told us about the path
+type AckSample struct {
+	Acked          uint32        // Bytes newly acknowledged
+	InFlight       uint32        // Bytes still unacknowledged after this ACK
+	RTT            time.Duration // Round trip time of the newest acknowledged segment, 0 if unknown
+	Time           time.Time     // When the ACK arrived
+	DeliveryRate   float64       // Bytes per second delivered while the newest acknowledged segment was in flight, 0 if unknown
+	PriorDelivered uint64        // Total bytes delivered when the newest acknowledged segment was sent
+}
+
+const DEFAULT_CONGESTION_CONTROL = "newreno"
+
+// Constructors for the algorithms a socket can be configured with, keyed by name
+var congestionControls = map[string]func() CongestionControl{
+	"newreno": func() CongestionControl { return &NewReno{} },
+	"cubic":   func() CongestionControl { return &Cubic{} },
+	"bbr":     func() CongestionControl { return &BBR{} },
+}
+
+func newCongestionControl(name string) (CongestionControl, error) {
+	constructor, ok := congestionControls[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown congestion control algorithm %q", name)
+	}
+	return constructor(), nil
+}
+
+// Names of every available algorithm, for help and error messages
+func CongestionControlNames() []string {
+	names := make([]string, 0, len(congestionControls))
+	for name := range congestionControls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Switches the socket to another algorithm, which starts over from its initial window
+func (socket *NormalSocket) SetCongestionControl(name string) error {
+	cc, err := newCongestionControl(name)
+	if err != nil {
+		return err
+	}
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.snd.cc = cc
+	socket.snd.pacingRate = 0
+	cc.Init(&socket.snd)
+	return nil
+}
+
+// Sets the algorithm used by sockets created from now on
+func (ts *TCPStack) SetDefaultCongestionControl(name string) error {
+	if _, err := newCongestionControl(name); err != nil {
+		return err
+	}
+	ts.congestionControl = name
+	return nil
+}
+
+// Gives a new connection the stack's default algorithm
+func (ts *TCPStack) initCongestionControl(snd *SND) {
+	cc, err := newCongestionControl(ts.congestionControl)
+	if err != nil {
+		cc = &NewReno{}
+	}
+	snd.cc = cc
+	cc.Init(snd)
+}
+
+// Records the connection's delivery state on a packet about to be sent
+// When the packet is acknowledged, the bytes delivered since then over the time taken give a
+// delivery rate sample, as in draft-cheng-iccrg-delivery-rate-estimation
+func (snd *SND) stampDelivery(packet *InFlightPacket) {
+	if len(snd.inFlightPackets.packets) == 0 {
+		// Nothing in flight, so the sample interval starts now
+		snd.deliveredTime = packet.timeSent
+		snd.firstSentTime = packet.timeSent
+	}
+	packet.delivered = snd.delivered
+	packet.deliveredTime = snd.deliveredTime
+	packet.firstSentTime = snd.firstSentTime
+}
+
+// Accounts for an acknowledged packet, returning its delivery rate sample
+// Must be called with the in-flight packets mutex held
+func (snd *SND) sampleDelivery(packet InFlightPacket, now time.Time) float64 {
+	snd.delivered += uint64(packet.Length)
+	snd.deliveredTime = now
+	snd.firstSentTime = packet.timeSent
+
+	if packet.deliveredTime.IsZero() {
+		return 0
+	}
+
+	// The slower of the send and ACK rates over the packet's flight, so ACK compression can't inflate it
+	interval := max(packet.timeSent.Sub(packet.firstSentTime), now.Sub(packet.deliveredTime))
+	if interval <= 0 {
+		return 0
+	}
+	return float64(snd.delivered-packet.delivered) / interval.Seconds()
+}
+
+// Blocks until an ACK arrives or the poll interval passes
+func (snd *SND) waitForAck() {
+	select {
+	case <-snd.ackSignal:
+	case <-time.After(WINDOW_POLL_INTERVAL):
+	}
+}
+
+// Wakes the sender if it is waiting for the window to open
+func (snd *SND) signalAck() {
+	select {
+	case snd.ackSignal <- struct{}{}:
+	default:
+	}
+}
+
+// How long the sender has to wait before the pacing rate allows another segment
+func (snd *SND) pacingDelay() time.Duration {
+	if snd.pacingRate <= 0 {
+		return 0
+	}
+	return time.Until(snd.nextSendTime)
+}
+
+// Arms the pacing timer, so a sender held back by the pacing rate can return instead of sleeping
+// with sendMutex held. The caller holds the socket's mutex
+func (socket *NormalSocket) schedulePacedSend(wait time.Duration) {
+	if socket.snd.pacingTimer != nil {
+		return
+	}
+	socket.snd.pacingTimer = time.AfterFunc(wait, socket.pacedSend)
+}
+
+// Runs when the pacing timer fires, sending what the pacing rate held back
+func (socket *NormalSocket) pacedSend() {
+	socket.mutex.Lock()
+	socket.snd.pacingTimer = nil
+	socket.mutex.Unlock()
+
+	select {
+	case socket.snd.pacingSignal <- struct{}{}:
+	default:
+	}
+	socket.kickSender()
+}
+
+// Blocks until the pacing timer fires or the poll interval passes
+func (snd *SND) waitForPacing() {
+	select {
+	case <-snd.pacingSignal:
+	case <-time.After(WINDOW_POLL_INTERVAL):
+	}
+}
+
+// Schedules the next segment after sending n bytes
+func (snd *SND) paced(n int) {
+	if snd.pacingRate <= 0 {
+		return
+	}
+	now := time.Now()
+	if snd.nextSendTime.Before(now) {
+		snd.nextSendTime = now
+	}
+	snd.nextSendTime = snd.nextSendTime.Add(time.Duration(float64(n) / snd.pacingRate * float64(time.Second)))
+}
+
+// Initial window from RFC 5681, which depends on the MSS the handshake settled on
+func initialWindow(snd *SND) uint32 {
+	switch {
+	case snd.MSS > 2190:
+		return 2 * snd.MSS
+	case snd.MSS > 1095:
+		return 3 * snd.MSS
+	default:
+		return 4 * snd.MSS
+	}
+}
+
+// ssthresh after a congestion event, half of what was in flight but at least two segments
+func halvedWindow(snd *SND) uint32 {
+	return max(snd.NXT.Sub(snd.UNA)/2, 2*snd.MSS)
+}
+
+// Reno-style fast recovery shared by the loss-based algorithms
+// On entry cwnd is ssthresh plus the three segments the duplicate ACKs show have left the network,
+// each further duplicate ACK inflates it by a segment, and a partial ACK deflates it by what was
+// acknowledged, adding back one segment for the retransmission (RFC 6582)
+func enterFastRecovery(snd *SND) {
+	snd.cwnd = snd.ssthresh + DUP_ACK_THRESHOLD*snd.MSS
+}
+
+func inflateWindow(snd *SND) {
+	if snd.inRecovery {
+		snd.cwnd += snd.MSS
+	}
+}
+
+func deflateWindow(snd *SND, acked uint32) {
+	if acked < snd.cwnd {
+		snd.cwnd -= acked
+	} else {
+		snd.cwnd = 0
+	}
+	snd.cwnd += snd.MSS
+}
+
+// NewReno (RFC 5681): exponential growth in slow start, one segment per RTT in congestion avoidance
+type NewReno struct {
+	// Bytes acknowledged since cwnd last grew in congestion avoidance
+	bytesAcked uint32
+}
+
+func (r *NewReno) Name() string {
+	return "newreno"
+}
+
+func (r *NewReno) Init(snd *SND) {
+	snd.cwnd = initialWindow(snd)
+	snd.ssthresh = uint32(snd.buf.Capacity())
+	r.bytesAcked = 0
+}
+
+func (r *NewReno) OnAck(snd *SND, sample AckSample) {
+	if snd.inRecovery {
+		deflateWindow(snd, sample.Acked)
+		return
+	}
+
+	if snd.cwnd < snd.ssthresh {
+		// Slow start, growing by at most one segment per ACK
+		snd.cwnd += uint32(min(int(sample.Acked), int(snd.MSS)))
+		return
+	}
+
+	// Congestion avoidance
+	r.bytesAcked += sample.Acked
+	if r.bytesAcked >= snd.cwnd {
+		r.bytesAcked -= snd.cwnd
+		snd.cwnd += snd.MSS
+	}
+}
+
+func (r *NewReno) OnDupAck(snd *SND) {
+	inflateWindow(snd)
+}
+
+func (r *NewReno) OnLoss(snd *SND) {
+	snd.ssthresh = halvedWindow(snd)
+	enterFastRecovery(snd)
+	r.bytesAcked = 0
+}
+
+func (r *NewReno) OnExitRecovery(snd *SND) {
+	snd.cwnd = snd.ssthresh
+}
+
+func (r *NewReno) OnRTO(snd *SND) {
+	snd.ssthresh = halvedWindow(snd)
+	snd.cwnd = snd.MSS
+	r.bytesAcked = 0
+}
@@ -7,19 +7,34 @@ import (
 
 // TODO: CHANGE DONT BE AN IDIOT AND FORGET
 
-const BUFFER_SIZE uint16 = 65535
-// const BUFFER_SIZE uint16 = 3
+// Send and receive buffer size of new connections unless the lnx file sets tcp buffer-size, see SetBufferSize
+// Windows beyond 64 KB are advertised with window scaling
+const DEFAULT_BUFFER_SIZE uint32 = 256 << 10
+
+// Buffers hold at least a full segment on any link, and at most what a window scale of 14 can advertise
+const MIN_BUFFER_SIZE uint32 = 16 << 10
+const MAX_BUFFER_SIZE uint32 = 1 << 30
 	
 const RTO_MAX_RETRIES = 3
 
-// const MAX_TCP_PAYLOAD = 1400 - int(unsafe.Sizeof(TCPHeader{})) - 20
-const MAX_TCP_PAYLOAD = 1000
+// Size of a TCP header without options
+const TCP_HEADER_LEN = 20
 
 const MIN_RTO = 1 * time.Second 
 
+// Full-sized in-order segments that are acknowledged right away instead of waiting for the delayed ACK timer
+const DELAYED_ACK_SEGMENTS = 2
+const DEFAULT_DELAYED_ACK_TIMEOUT = 40 * time.Millisecond
+
+// Duplicate ACKs that signal a lost segment and trigger fast retransmit
+const DUP_ACK_THRESHOLD = 3
+
 const ZWP_RETRIES = 30
 const ZWP_PROBE_INTERVAL = 1 * time.Second
 
 const MSL = 4 * time.Second
 
-const HANDSHAKE_TIMEOUT = 10 * time.Second
\ No newline at end of file
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Longest a sender with a full window sleeps before checking it again, in case an ACK signal is missed
+const WINDOW_POLL_INTERVAL = 10 * time.Millisecond
\ No newline at end of file
@@ -0,0 +1,177 @@
+package tcpstack
+
+import (
+	"math"
+	"time"
+)
+
+// CUBIC (RFC 8312) grows the window as a cubic function of the time since the last congestion event,
+// so recovery towards the previous maximum is fast and probing beyond it starts slowly.
+// Slow start exits early with HyStart once RTTs start rising, before the queue overflows
+
+const (
+	CUBIC_C    = 0.4
+	CUBIC_BETA = 0.7
+)
+
+// HyStart parameters from RFC 9406
+const (
+	HYSTART_MIN_SAMPLES = 8
+	HYSTART_MIN_ETA     = 4 * time.Millisecond
+	HYSTART_MAX_ETA     = 16 * time.Millisecond
+)
+
+type Cubic struct {
+	wMax       float64   // Window before the last reduction, in segments
+	wLastMax   float64   // wMax before that, for fast convergence
+	k          float64   // Seconds the cubic function takes to grow back to wMax
+	epochStart time.Time // Start of the current congestion avoidance epoch, zero when not started
+	originW    float64   // Window at the start of the epoch, in segments
+	wEst       float64   // Window standard TCP would have, in segments
+	cwndCount  float64   // Fraction of a segment accumulated towards the next increase
+	minRTT     time.Duration
+
+	// HyStart round tracking
+	roundEnd        SequenceNumber // The round ends when this sequence number is acknowledged
+	lastRoundMinRTT time.Duration  // Minimum RTT in the previous round
+	roundMinRTT     time.Duration  // Minimum RTT so far in this round
+	roundSamples    int
+}
+
+func (c *Cubic) Name() string {
+	return "cubic"
+}
+
+func (c *Cubic) Init(snd *SND) {
+	*c = Cubic{}
+	snd.cwnd = initialWindow(snd)
+	snd.ssthresh = uint32(snd.buf.Capacity())
+	c.roundEnd = snd.NXT
+}
+
+func (c *Cubic) OnAck(snd *SND, sample AckSample) {
+	if snd.inRecovery {
+		deflateWindow(snd, sample.Acked)
+		return
+	}
+
+	if sample.RTT > 0 && (c.minRTT == 0 || sample.RTT < c.minRTT) {
+		c.minRTT = sample.RTT
+	}
+
+	if snd.cwnd < snd.ssthresh {
+		c.hystart(snd, sample)
+		if snd.cwnd < snd.ssthresh {
+			snd.cwnd += uint32(min(int(sample.Acked), int(snd.MSS)))
+			return
+		}
+	}
+
+	c.congestionAvoidance(snd, sample)
+}
+
+// Leaves slow start when the minimum RTT of a round rises noticeably above the previous round's
+func (c *Cubic) hystart(snd *SND, sample AckSample) {
+	if sample.RTT > 0 {
+		if c.roundMinRTT == 0 || sample.RTT < c.roundMinRTT {
+			c.roundMinRTT = sample.RTT
+		}
+		c.roundSamples++
+	}
+
+	if c.roundSamples >= HYSTART_MIN_SAMPLES && c.lastRoundMinRTT > 0 {
+		eta := max(c.lastRoundMinRTT/8, HYSTART_MIN_ETA)
+		if eta > HYSTART_MAX_ETA {
+			eta = HYSTART_MAX_ETA
+		}
+		if c.roundMinRTT >= c.lastRoundMinRTT+eta {
+			snd.ssthresh = snd.cwnd
+			return
+		}
+	}
+
+	// Start a new round once everything sent in this one is acknowledged
+	if snd.UNA.GEQ(c.roundEnd) {
+		c.roundEnd = snd.NXT
+		if c.roundSamples > 0 {
+			c.lastRoundMinRTT = c.roundMinRTT
+		}
+		c.roundMinRTT = 0
+		c.roundSamples = 0
+	}
+}
+
+func (c *Cubic) congestionAvoidance(snd *SND, sample AckSample) {
+	cwnd := float64(snd.cwnd) / float64(snd.MSS)
+	acked := float64(sample.Acked) / float64(snd.MSS)
+
+	if c.epochStart.IsZero() {
+		c.epochStart = sample.Time
+		c.cwndCount = 0
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / CUBIC_C)
+			c.originW = c.wMax
+		} else {
+			c.k = 0
+			c.originW = cwnd
+		}
+		c.wEst = cwnd
+	}
+
+	// Aim for where the curve will be one RTT from now
+	t := sample.Time.Sub(c.epochStart) + c.minRTT
+	offset := t.Seconds() - c.k
+	target := c.originW + CUBIC_C*offset*offset*offset
+
+	// Never grow slower than standard TCP would in the same time
+	c.wEst += 3 * (1 - CUBIC_BETA) / (1 + CUBIC_BETA) * acked / cwnd
+	target = max(target, c.wEst)
+
+	// Grow by (target - cwnd) / cwnd per segment acknowledged, but at most half a segment per segment
+	if target > cwnd {
+		c.cwndCount += math.Min((target-cwnd)/cwnd, 0.5) * acked
+	} else {
+		c.cwndCount += acked / (100 * cwnd)
+	}
+
+	if c.cwndCount >= 1 {
+		segments := math.Floor(c.cwndCount)
+		c.cwndCount -= segments
+		snd.cwnd += uint32(segments) * snd.MSS
+	}
+}
+
+// Remembers where the window was and cuts it by beta
+func (c *Cubic) reduce(snd *SND) {
+	cwnd := float64(snd.cwnd) / float64(snd.MSS)
+
+	// Fast convergence: if we lost before reaching the previous maximum, give up some of it to other flows
+	if cwnd < c.wLastMax {
+		c.wLastMax = cwnd
+		c.wMax = cwnd * (1 + CUBIC_BETA) / 2
+	} else {
+		c.wLastMax = cwnd
+		c.wMax = cwnd
+	}
+
+	c.epochStart = time.Time{}
+	snd.ssthresh = max(uint32(float64(snd.cwnd)*CUBIC_BETA), 2*snd.MSS)
+}
+
+func (c *Cubic) OnDupAck(snd *SND) {
+	inflateWindow(snd)
+}
+
+func (c *Cubic) OnLoss(snd *SND) {
+	c.reduce(snd)
+	enterFastRecovery(snd)
+}
+
+func (c *Cubic) OnExitRecovery(snd *SND) {
+	snd.cwnd = snd.ssthresh
+}
+
+func (c *Cubic) OnRTO(snd *SND) {
+	c.reduce(snd)
+	snd.cwnd = snd.MSS
+}
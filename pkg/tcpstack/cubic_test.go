@@ -0,0 +1,77 @@
+package tcpstack
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A path with a 20ms round trip that loses 1% of data segments, long and lossy enough that the
+// congestion controller decides how quickly a transfer finishes. Returns how long the transfer took,
+// how many segments the sender retransmitted and how many the link lost
+func lossyTransfer(tb testing.TB, algorithm string, size int, seed int64) (elapsed time.Duration, retransmitted, lost int) {
+	tb.Helper()
+	var dropped atomic.Int64
+	drop := lossyDrop(0.01, seed)
+	link := &testLink{delay: 10 * time.Millisecond, drop: func(header *TCPHeader, payload []byte) bool {
+		if drop(header, payload) {
+			dropped.Add(1)
+			return true
+		}
+		return false
+	}}
+	a, b := newTestPair(tb, link)
+	if err := a.tcp.SetDefaultCongestionControl(algorithm); err != nil {
+		tb.Fatal(err)
+	}
+	client, server := connectPair(tb, a, b, 80)
+	if name := locked(client, func() string { return client.snd.cc.Name() }); name != algorithm {
+		tb.Fatalf("connection uses %s, want %s", name, algorithm)
+	}
+
+	data := pattern(size)
+	start := time.Now()
+	if got := transfer(tb, client, server, data); !bytes.Equal(got, data) {
+		tb.Fatalf("%s: received %d bytes that don't match the %d sent", algorithm, len(got), len(data))
+	}
+	return time.Since(start), locked(client, func() int { return client.snd.retransmitted }), int(dropped.Load())
+}
+
+func TestCongestionControlOverLossyLink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes several seconds")
+	}
+	const size = 256 * 1024
+	for _, algorithm := range []string{"newreno", "cubic"} {
+		elapsed, retransmitted, lost := lossyTransfer(t, algorithm, size, 1)
+		t.Logf("%s: %dKB in %v, %d segments lost and %d retransmitted",
+			algorithm, size/1024, elapsed.Round(time.Millisecond), lost, retransmitted)
+
+		// Every lost segment has to be sent again. Timeouts resend what was in flight behind the loss
+		// as well, but resending much more than the window's worth per loss means recovery went wrong
+		if lost == 0 {
+			t.Fatalf("%s: the link lost nothing, pick another seed", algorithm)
+		}
+		if retransmitted < lost {
+			t.Errorf("%s: %d segments lost but only %d retransmitted", algorithm, lost, retransmitted)
+		}
+		if retransmitted > 20*lost {
+			t.Errorf("%s: %d segments lost but %d retransmitted", algorithm, lost, retransmitted)
+		}
+	}
+}
+
+// go test -run '^$' -bench CongestionControl ./pkg/tcpstack
+func BenchmarkCongestionControlOverLossyLink(b *testing.B) {
+	for _, algorithm := range []string{"newreno", "cubic"} {
+		b.Run(algorithm, func(b *testing.B) {
+			retransmitted := 0
+			for i := 0; i < b.N; i++ {
+				_, n, _ := lossyTransfer(b, algorithm, 4*1024*1024, int64(i))
+				retransmitted += n
+			}
+			b.ReportMetric(float64(retransmitted)/float64(b.N), "retransmits/op")
+		})
+	}
+}
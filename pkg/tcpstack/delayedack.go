@@ -0,0 +1,50 @@
+package tcpstack
+
+import "time"
+
+// Delayed ACKs (RFC 1122 section 4.2.3.2, RFC 5681 section 4.2)
+// In-order data is acknowledged on every second full-sized segment, or once the delayed ACK timeout
+// passes. Smaller segments only start the timer. Any segment we send carries the ACK too, so data
+// going the other way cancels the pending one
+
+// Sets how long ACKs wait for a second segment on connections created from now on, 0 disables delaying
+func (ts *TCPStack) SetDelayedAckTimeout(timeout time.Duration) {
+	ts.delayedAckTimeout = timeout
+}
+
+// Acknowledges a segment of in-order data, now if it is the second full-sized one since our last ACK
+// and otherwise when the timer fires
+func (socket *NormalSocket) ackInOrderData(fullSized bool) {
+	socket.rcv.ackMutex.Lock()
+	if fullSized {
+		socket.rcv.unackedSegments++
+	}
+	if socket.rcv.delayedAckTimeout == 0 || socket.rcv.unackedSegments >= DELAYED_ACK_SEGMENTS {
+		socket.rcv.ackMutex.Unlock()
+		socket.sendAck()
+		return
+	}
+	if socket.rcv.ackTimer == nil {
+		socket.rcv.ackTimer = time.AfterFunc(socket.rcv.delayedAckTimeout, socket.sendDelayedAck)
+	}
+	socket.rcv.ackMutex.Unlock()
+}
+
+// Records that a segment acknowledging everything received so far went out, cancelling any delayed ACK
+func (socket *NormalSocket) ackSent() {
+	socket.rcv.ackMutex.Lock()
+	defer socket.rcv.ackMutex.Unlock()
+
+	socket.rcv.unackedSegments = 0
+	if socket.rcv.ackTimer != nil {
+		socket.rcv.ackTimer.Stop()
+		socket.rcv.ackTimer = nil
+	}
+}
+
+// Sends the ACK when the delayed ACK timer fires, off the packet handler
+func (socket *NormalSocket) sendDelayedAck() {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.sendAck()
+}
@@ -0,0 +1,61 @@
+package tcpstack
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Small segments wait for the delayed ACK timer, full-sized ones are acknowledged every second one
+func TestDelayedAckCountsFullSegments(t *testing.T) {
+	var acks, fullSegments, mss atomic.Int64
+	link := &testLink{delay: 2 * time.Millisecond, drop: func(header *TCPHeader, payload []byte) bool {
+		if header.SourcePort == 80 && header.Flags == TCP_ACK && len(payload) == 0 {
+			acks.Add(1)
+		}
+		if header.DestPort == 80 && int64(len(payload)+int(header.DataOffset)*4-TCP_HEADER_LEN) >= mss.Load() {
+			fullSegments.Add(1)
+		}
+		return false
+	}}
+	a, b := newTestPair(t, link)
+	client, server := connectPair(t, a, b, 80)
+	client.SetNoDelay(true)
+	mss.Store(int64(locked(client, func() uint32 { return client.snd.MSS })))
+
+	// Ten small segments in a burst much shorter than the delayed ACK timeout
+	small := pattern(100)
+	for i := 0; i < 10; i++ {
+		if err := client.VWrite(small[i*10 : i*10+10]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]byte, len(small))
+	for n := 0; n < len(got); {
+		read, err := server.VRead(got[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += read
+	}
+	if !bytes.Equal(got, small) {
+		t.Fatalf("server received %q", got)
+	}
+	time.Sleep(3 * DEFAULT_DELAYED_ACK_TIMEOUT)
+	if n := acks.Load(); n >= 5 {
+		t.Errorf("10 small segments got %d ACKs, want them left to the delayed ACK timer", n)
+	}
+
+	// Windows that don't fit a whole segment make some of these smaller, so only the full ones count
+	acks.Store(0)
+	fullSegments.Store(0)
+	data := pattern(256 * 1024)
+	if got := transfer(t, client, server, data); !bytes.Equal(got, data) {
+		t.Fatalf("server received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	time.Sleep(3 * DEFAULT_DELAYED_ACK_TIMEOUT)
+	if n, segments := acks.Load(), fullSegments.Load(); segments == 0 || n < segments/2 {
+		t.Errorf("%d full-sized segments got %d ACKs, want one for every second segment", segments, n)
+	}
+}
@@ -2,6 +2,7 @@ package tcpstack
 
 import (
 	"fmt"
+	"ip-rip-in-peace/pkg/ipstack"
 	"net/netip"
 	"time"
 
@@ -9,21 +10,62 @@ import (
 )
 
 func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) error {
-	header, payload := ParseTCPHeader(packet)
+	// Summing a segment together with its checksum gives zero unless something changed on the way
+	if computeChecksum(srcAddr.AsSlice(), dstAddr.AsSlice(), uint8(ipstack.TCP_PROTOCOL), packet) != 0 {
+		ts.checksumErrors.Add(1)
+		return fmt.Errorf("dropping segment from %s with a bad checksum", srcAddr)
+	}
+
+	header, payload, err := ParseTCPHeader(packet)
+	if err != nil {
+		return err
+	}
 
 	entry, err := ts.VFindTableEntry(dstAddr, header.DestPort, srcAddr, header.SourcePort)
 	if err != nil {
 		return err
 	}
 
+	// The connection's state is the socket's own, the timers and user calls wait for us to finish
+	if socket, ok := entry.SocketStruct.(*NormalSocket); ok {
+		socket.mutex.Lock()
+		defer socket.mutex.Unlock()
+	}
+
 	//fmt.Println("Handling packet for", entry.LocalAddress, entry.LocalPort, entry.RemoteAddress, entry.RemotePort, entry.State)
 
+	// PAWS, an old duplicate is acknowledged so the peer resynchronizes, but otherwise ignored
+	if socket, ok := entry.SocketStruct.(*NormalSocket); ok && entry.State != TCP_SYN_SENT {
+		if !socket.acceptTimestamp(header) {
+			socket.sendAck()
+			return nil
+		}
+		socket.touch()
+	}
+
 	// Handle RST, immediately terminate connection for normal sockets
 	if header.Flags&TCP_RST != 0 && entry.State != TCP_LISTEN {
 		handleRST(ts, entry)
 		return nil
 	}
 
+	// Segment acceptability, see acceptability.go
+	if socket, ok := entry.SocketStruct.(*NormalSocket); ok && synchronized(entry.State) {
+		if !socket.acceptable(header, payload) {
+			// Old duplicates, keepalive probes and anything past the window get an ACK telling the peer
+			// what we expect next, and are dropped
+			socket.sendAck()
+			return nil
+		}
+
+		var trimmed bool
+		payload, trimmed = socket.trimToWindow(header, payload)
+		if trimmed && len(payload) == 0 && header.Flags&TCP_FIN == 0 {
+			// No data left to acknowledge on the way, but the peer still needs to hear what we took
+			defer socket.sendAck()
+		}
+	}
+
 	//fmt.Println("Handling packet in state: ", entry.State)
 
 	switch entry.State {
@@ -38,6 +80,8 @@ func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) err
 	case TCP_SYN_SENT:
 		if header.Flags&TCP_SYN != 0 && header.Flags&TCP_ACK != 0 {
 			handleSYNACK(ts, entry, header)
+		} else if header.Flags&TCP_SYN != 0 {
+			handleSimultaneousSYN(ts, entry, header)
 		}
 
 	case TCP_SYN_RECEIVED:
@@ -51,20 +95,22 @@ func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) err
 			handleEstablishedPacket(ts, entry, header, payload)
 		}
 		if header.Flags&TCP_FIN != 0 {
-			handleFIN(ts, entry, header)
+			handleFIN(ts, entry, header, payload)
 		}
 
 	// Tear down
 	case TCP_FIN_WAIT_1:
-		// if header.Flags&TCP_FIN != 0 {
-		// 	handleFIN(ts, entry, header)
-		// } This would be a simultaneous close, which we don't support
 		if len(payload) > 0 {
 			handleEstablishedPacket(ts, entry, header, payload)
 		}
+		// An ACK of our FIN moves us to FIN_WAIT_2 first, so a FIN on the same segment goes straight to TIME_WAIT
 		if header.Flags&TCP_ACK != 0 {
 			handleClosingACK(ts, entry, header)
 		}
+		// Otherwise the FINs crossed, which is a simultaneous close
+		if header.Flags&TCP_FIN != 0 {
+			handleFIN(ts, entry, header, payload)
+		}
 	case TCP_FIN_WAIT_2:
 		// if header.Flags&TCP_ACK != 0 {
 		// 	handleEstablishedACK(ts, entry, header) // We may need this for retransmissions, but we should've sent all other packets already
@@ -73,7 +119,7 @@ func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) err
 			handleEstablishedPacket(ts, entry, header, payload)
 		}
 		if header.Flags&TCP_FIN != 0 {
-			handleFIN(ts, entry, header)
+			handleFIN(ts, entry, header, payload)
 		}
 		if header.Flags&TCP_ACK != 0 {
 			handleClosingACK(ts, entry, header)
@@ -81,7 +127,7 @@ func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) err
 
 	case TCP_CLOSE_WAIT:
 		// if header.Flags&TCP_FIN != 0 {
-		// 	handleFIN(ts, entry, header)
+		// 	handleFIN(ts, entry, header, payload)
 		// }
 		// Should do nothing here
 
@@ -89,10 +135,14 @@ func (ts *TCPStack) HandlePacket(srcAddr, dstAddr netip.Addr, packet []byte) err
 		if header.Flags&TCP_ACK != 0 {
 			handleClosingACK(ts, entry, header)
 		}
+		// The peer didn't get our ACK of its FIN
+		if header.Flags&TCP_FIN != 0 {
+			handleFIN(ts, entry, header, payload)
+		}
 
 	case TCP_TIME_WAIT:
 		if header.Flags&TCP_FIN != 0 {
-			handleFIN(ts, entry, header)
+			handleFIN(ts, entry, header, payload)
 		}
 		if header.Flags&TCP_ACK != 0 {
 			handleClosingACK(ts, entry, header)
@@ -126,32 +176,39 @@ func handleSYN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, srcAddr ne
 
 	// Initialize send/receive state
 	newSocket.snd = SND{
-		buf:             ringbuffer.New(int(BUFFER_SIZE)),
+		buf:             ringbuffer.New(int(ts.bufferSize)),
 		ISS:             newSocket.SeqNum,
 		UNA:             newSocket.SeqNum,
 		NXT:             newSocket.SeqNum + 1, // +1 for SYN
-		WND:             header.WindowSize,
+		WND:             uint32(header.WindowSize), // Windows in SYNs are never scaled
 		RTOtimer:        time.NewTimer(MIN_RTO), // This is the default value
 		calculatedRTO:   MIN_RTO,
 		SRTT:            0,
 		RTTVAR:          0,
 		retransmissions: 0,
+		ackSignal:       make(chan struct{}, 1),
+		pacingSignal:    make(chan struct{}, 1),
 	}
 	newSocket.snd.RTOtimer.Stop()
 	newSocket.snd.buf.SetBlocking(true)
+	newSocket.rcvWindowShift = windowShift(ts.bufferSize)
+	newSocket.negotiateOptions(&header.Options)
+	ts.initCongestionControl(&newSocket.snd)
 
 	newSocket.rcv = RCV{
-		buf: ringbuffer.New(int(BUFFER_SIZE)),
-		IRS: header.SeqNum,
-		NXT: header.SeqNum + 1, // +1 for SYN
-		WND: BUFFER_SIZE,
+		buf:               ringbuffer.New(int(ts.bufferSize)),
+		IRS:               header.SeqNum,
+		NXT:               header.SeqNum + 1, // +1 for SYN
+		WND:               ts.bufferSize,
+		delayedAckTimeout: ts.delayedAckTimeout,
 	}
 	newSocket.rcv.buf.SetBlocking(true)
+	newSocket.SetKeepalive(ts.keepalive)
 
 	// Get the listening socket to add to accept queue
 	listenSocket := entry.SocketStruct.(*ListenSocket)
 
-	newEntry := TCPTableEntry{
+	newEntry := &TCPTableEntry{
 		LocalAddress:  entry.LocalAddress,
 		LocalPort:     entry.LocalPort,
 		RemoteAddress: srcAddr,
@@ -159,6 +216,9 @@ func handleSYN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, srcAddr ne
 		State:         TCP_SYN_RECEIVED,
 		SocketStruct:  newSocket,
 	}
+	// Its timers can fire as soon as it is in the table
+	newSocket.mutex.Lock()
+	defer newSocket.mutex.Unlock()
 	ts.VInsertTableEntry(newEntry)
 
 	// Send SYN-ACK with our window size
@@ -169,7 +229,8 @@ func handleSYN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, srcAddr ne
 		AckNum:     newSocket.AckNum,
 		DataOffset: 5,
 		Flags:      TCP_SYN | TCP_ACK,
-		WindowSize: newSocket.rcv.WND, // Advertise our receive window
+		WindowSize: synWindow(newSocket.rcv.WND), // Advertise our receive window
+		Options:    newSocket.synOptions(&header.Options),
 	}
 
 
@@ -181,6 +242,7 @@ func handleSYN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, srcAddr ne
 		timeSent:    time.Now(),
 		flags:       synAckHeader.Flags,
 		windowFlags: synAckHeader.WindowSize,
+		options:     synAckHeader.Options,
 	})
 	newSocket.snd.inFlightPackets.mutex.Unlock()
 
@@ -208,7 +270,12 @@ func handleSYNACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 	// Update send state
 	socket.snd.UNA = header.AckNum
 	socket.snd.NXT = header.AckNum
-	socket.snd.WND = header.WindowSize // Store peer's advertised window
+	socket.snd.WND = uint32(header.WindowSize) // Store peer's advertised window, never scaled in a SYN
+	socket.negotiateOptions(&header.Options)
+	// The initial window depends on the MSS we just learned
+	socket.snd.cc.Init(&socket.snd)
+	// The SYN-ACK echoes our SYN's timestamp, giving an RTT sample before any data is sent
+	socket.sampleTimestampRTT(header)
 
 	entry.State = TCP_ESTABLISHED
 
@@ -226,7 +293,8 @@ func handleSYNACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 		AckNum:     socket.rcv.NXT,
 		DataOffset: 5,
 		Flags:      TCP_ACK,
-		WindowSize: socket.rcv.WND, // Advertise our receive window
+		WindowSize: socket.advertisedWindow(), // Advertise our receive window
+		Options:    socket.segmentOptions(),
 	}
 
 	// We just set inflightpackets to empty and stop the timer here because we don't need to track the SYN-ACK, since it won't be acknowledged
@@ -244,12 +312,19 @@ func handleACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 	entry.State = TCP_ESTABLISHED
 	socket.SeqNum++
 	socket.AckNum = header.SeqNum + 1
+	socket.snd.UNA = header.AckNum // Our SYN is acknowledged
 
-	// If this is from a listening socket's child, add to accept queue
-	parentEntry, err := ts.VFindTableEntry(entry.LocalAddress, entry.LocalPort, netip.Addr{}, 0)
-	if err == nil && parentEntry.State == TCP_LISTEN {
-		listenSocket := parentEntry.SocketStruct.(*ListenSocket)
-		listenSocket.acceptQueue <- socket
+	if socket.establishedChan != nil {
+		// We got here through a simultaneous open, so VConnect is the one waiting
+		close(socket.establishedChan)
+		socket.establishedChan = nil
+	} else {
+		// If this is from a listening socket's child, add to accept queue
+		parentEntry, err := ts.VFindTableEntry(entry.LocalAddress, entry.LocalPort, netip.Addr{}, 0)
+		if err == nil && parentEntry.State == TCP_LISTEN {
+			listenSocket := parentEntry.SocketStruct.(*ListenSocket)
+			listenSocket.acceptQueue <- socket
+		}
 	}
 
 	// Clean up in-flight packets
@@ -265,6 +340,51 @@ func handleACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 	fmt.Printf("Connection established with %s:%d\n", entry.RemoteAddress, entry.RemotePort)
 }
 
+// Simultaneous open, our SYN crossed the peer's (RFC 9293 section 3.5)
+// We acknowledge its SYN with a SYN-ACK for our own and wait in SYN_RECEIVED for the peer's SYN-ACK
+func handleSimultaneousSYN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
+	socket := entry.SocketStruct.(*NormalSocket)
+
+	// Update receive state with peer's initial values
+	socket.AckNum = header.SeqNum + 1
+	socket.rcv.IRS = header.SeqNum
+	socket.rcv.NXT = header.SeqNum + 1 // +1 for SYN
+
+	// Both SYNs offered every option, so the peer's says what both sides support
+	socket.snd.WND = uint32(header.WindowSize) // Never scaled in a SYN
+	socket.negotiateOptions(&header.Options)
+	socket.snd.cc.Init(&socket.snd)
+
+	entry.State = TCP_SYN_RECEIVED
+
+	synAckHeader := &TCPHeader{
+		SourcePort: entry.LocalPort,
+		DestPort:   entry.RemotePort,
+		SeqNum:     socket.snd.ISS,
+		AckNum:     socket.rcv.NXT,
+		DataOffset: 5,
+		Flags:      TCP_SYN | TCP_ACK,
+		WindowSize: synWindow(socket.rcv.WND),
+		Options:    socket.synOptions(&header.Options),
+	}
+
+	// The SYN-ACK takes our SYN's place in flight, so a timeout resends it instead
+	socket.snd.inFlightPackets.mutex.Lock()
+	socket.snd.inFlightPackets.packets = []InFlightPacket{{
+		SeqNum:      synAckHeader.SeqNum,
+		Length:      0,
+		timeSent:    time.Now(),
+		flags:       synAckHeader.Flags,
+		windowFlags: synAckHeader.WindowSize,
+		options:     synAckHeader.Options,
+	}}
+	socket.snd.inFlightPackets.mutex.Unlock()
+	socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
+
+	packet := serializeTCPPacket(synAckHeader, nil)
+	ts.sendPacket(entry.RemoteAddress, packet)
+}
+
 // Established functions
 func handleData(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, payload []byte) {
 	socket := entry.SocketStruct.(*NormalSocket)
@@ -275,63 +395,66 @@ func handleData(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, payload [
 
 	if header.SeqNum == socket.rcv.NXT {
 		// Next expected sequence number matches, process in order data
-		processInOrderData(socket, payload)
-	} else if header.SeqNum != socket.rcv.NXT { // != so that we take into account repeated data, which will be the case for retransmissions and ZWP
-		//fmt.Println("Out of order packet received")
-		// Store out of order data
-		socket.rcv.earlyData = append(socket.rcv.earlyData, EarlyData{
-			data:   payload,
-			SeqNum: header.SeqNum,
-			Length: uint16(len(payload)),
-		})
-
-		// Send duplicate ACK for the last in order se received
-		ackHeader := &TCPHeader{
-			SourcePort: entry.LocalPort,
-			DestPort:   entry.RemotePort,
-			SeqNum:     socket.snd.NXT,
-			AckNum:     socket.rcv.NXT, // next expected seq num
-			DataOffset: 5,
-			Flags:      TCP_ACK,
-			WindowSize: socket.rcv.WND,
-		}
-
-		packet := serializeTCPPacket(ackHeader, nil)
-		ts.sendPacket(entry.RemoteAddress, packet)
+		processInOrderData(socket, payload, socket.fullSized(header, payload))
+		return
 	}
+
+	// Store out of order data, it was already trimmed to the window
+	socket.rcv.earlyData.insert(header.SeqNum, payload, socket.rcv.NXT, socket.rcv.WND)
+	// Send duplicate ACK for the last in order se received
+	socket.sendAck()
 }
 
-func processInOrderData(socket *NormalSocket, payload []byte) {
-	n, err := socket.rcv.buf.Write(payload)
-	if err != nil {
-		fmt.Printf("Error writing to receive buffer: %v\n", err)
+func processInOrderData(socket *NormalSocket, payload []byte, fullSized bool) {
+	if !socket.deliver(payload) {
 		return
 	}
 
-	socket.rcv.NXT += uint32(n)
+	// Queued data that is now in order comes out in one piece, since touching ranges are merged
+	filledGap := false
+	if data := socket.rcv.earlyData.front(socket.rcv.NXT); data != nil {
+		socket.deliver(data)
+		filledGap = true
+	}
 
-	// Iterate as long as we find packets that are now in order
-	for {
-		nextPacket := findNextSequence(socket.rcv.earlyData, socket.rcv.NXT)
-		if nextPacket == nil {
-			break
-		}
+	socket.rcv.WND = uint32(socket.rcv.buf.Free())
 
-		n, err := socket.rcv.buf.Write(nextPacket.data)
-		if err != nil {
-			fmt.Printf("Error writing early data to receive buffer: %v\n", err)
-			break
-		}
+	// Send ACK for all processed data
+	// Per RFC spec, sending ACK for last in order byte received
+	// While there are holes the sender needs every ACK for fast retransmit, so only delay in the common case
+	if filledGap || !socket.rcv.earlyData.empty(socket.rcv.NXT) {
+		socket.sendAck()
+	} else {
+		socket.ackInOrderData(fullSized)
+	}
+}
 
-		socket.rcv.NXT += uint32(n)
+// Reports whether a segment carried as much as the MSS allows, counting its options like the sender does
+// Both ends settle on the smaller of the two MSS values, so ours is the one the peer sends with
+func (socket *NormalSocket) fullSized(header *TCPHeader, payload []byte) bool {
+	optionsLen := int(header.DataOffset)*4 - TCP_HEADER_LEN
+	return len(payload)+optionsLen >= int(socket.snd.MSS)
+}
 
-		socket.rcv.earlyData = removePacket(socket.rcv.earlyData, nextPacket.SeqNum)
+// Appends in-order data to the receive buffer and moves RCV.NXT past what was stored
+// Segments are trimmed to the window, which is at most the free space, so it all fits. Should the
+// buffer fail anyway, only what was stored is acknowledged and the peer resends the rest
+func (socket *NormalSocket) deliver(data []byte) bool {
+	if len(data) == 0 {
+		return true
 	}
 
-	socket.rcv.WND = uint16(socket.rcv.buf.Free())
+	n, err := socket.rcv.buf.Write(data)
+	socket.rcv.NXT = socket.rcv.NXT.Add(uint32(n))
+	if err != nil {
+		fmt.Printf("Error writing to receive buffer: %v\n", err)
+		return false
+	}
+	return true
+}
 
-	// Send ACK for all processed data
-	// Per RFC spec, sending ACK for last in order byte received
+// Acknowledges everything received in order so far, with SACK blocks for anything beyond it
+func (socket *NormalSocket) sendAck() {
 	ackHeader := &TCPHeader{
 		SourcePort: socket.LocalPort,
 		DestPort:   socket.RemotePort,
@@ -339,36 +462,24 @@ func processInOrderData(socket *NormalSocket, payload []byte) {
 		AckNum:     socket.rcv.NXT,
 		DataOffset: 5,
 		Flags:      TCP_ACK,
-		WindowSize: socket.rcv.WND,
+		WindowSize: socket.advertisedWindow(),
+		Options:    socket.segmentOptions(),
 	}
+	socket.ackSent()
 
 	packet := serializeTCPPacket(ackHeader, nil)
 	socket.tcpStack.sendPacket(socket.RemoteAddress, packet)
 }
 
-func findNextSequence(earlyData []EarlyData, expectedSeq uint32) *EarlyData {
-	for i := range earlyData {
-		if earlyData[i].SeqNum == expectedSeq {
-			return &earlyData[i]
-		}
-	}
-	return nil
-}
-
-func removePacket(earlyData []EarlyData, seqNum uint32) []EarlyData {
-	for i := range earlyData {
-		if earlyData[i].SeqNum == seqNum {
-			return append(earlyData[:i], earlyData[i+1:]...)
-		}
-	}
-	return earlyData
-}
-
 func handleEstablishedPacket(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, payload []byte) {
 	socket := entry.SocketStruct.(*NormalSocket)
 
 	// Update send window
-	socket.snd.WND = header.WindowSize
+	prevWND := socket.snd.WND
+	socket.snd.WND = socket.peerWindow(header)
+	if socket.snd.WND != prevWND {
+		socket.snd.signalAck()
+	}
 
 	// 1. Process any data
 	if len(payload) > 0 {
@@ -377,15 +488,45 @@ func handleEstablishedPacket(ts *TCPStack, entry *TCPTableEntry, header *TCPHead
 
 	// 2. Process ACK if present and there are in flight packets
 	if header.Flags&TCP_ACK != 0 && len(socket.snd.inFlightPackets.packets) > 0 {
+		if socket.sackPermitted {
+			socket.markSacked(header.Options.SACK)
+		}
+
+		// An ACK for data we never sent is answered with what we actually sent and otherwise ignored
+		if header.AckNum.GT(socket.snd.NXT) {
+			socket.sendAck()
+			return
+		}
+
 		// Ignore old ACKs
-		if header.AckNum <= socket.snd.UNA {
+		if header.AckNum.LEQ(socket.snd.UNA) {
+			// An ACK for nothing new that carries no data or FIN and doesn't move the window is a duplicate
+			if header.AckNum == socket.snd.UNA && len(payload) == 0 && header.Flags&TCP_FIN == 0 && socket.snd.WND == prevWND {
+				handleDupAck(socket)
+			}
 			return
 		}
 
+		acked := header.AckNum.Sub(socket.snd.UNA)
 		socket.snd.UNA = header.AckNum
+		socket.snd.dupAcks = 0
 
 		// Clean up in-flight packets
-		cleanUpInFlightPackets(socket, header)
+		sample := cleanUpInFlightPackets(socket, header)
+		sample.Acked = acked
+		sample.InFlight = socket.snd.NXT.Sub(socket.snd.UNA)
+
+		if socket.snd.inRecovery && header.AckNum.GEQ(socket.snd.recover) {
+			// Everything outstanding at the loss is acknowledged
+			socket.snd.inRecovery = false
+			socket.snd.cc.OnExitRecovery(&socket.snd)
+		} else {
+			socket.snd.cc.OnAck(&socket.snd, sample)
+			if socket.snd.inRecovery {
+				// A partial ACK means the next hole was lost too, so resend it right away
+				socket.retransmitHole()
+			}
+		}
 
 		// Reset retransmission timer if we have unacked data
 		if len(socket.snd.inFlightPackets.packets) > 0 {
@@ -396,21 +537,56 @@ func handleEstablishedPacket(ts *TCPStack, entry *TCPTableEntry, header *TCPHead
 
 		// Reset retransmission count on successful ACK
 		socket.snd.retransmissions = 0
+
+		socket.snd.signalAck()
+		socket.kickSender()
 	}
 }
 
-func cleanUpInFlightPackets(socket *NormalSocket, header *TCPHeader) {
+// Counts a duplicate ACK, starting fast retransmit and recovery on the third one
+func handleDupAck(socket *NormalSocket) {
+	socket.snd.dupAcks++
+	socket.snd.cc.OnDupAck(&socket.snd)
+
+	if socket.snd.inRecovery {
+		// With SACK every duplicate ACK can reveal another hole to fill
+		socket.retransmitHole()
+		return
+	}
+
+	if socket.snd.dupAcks != DUP_ACK_THRESHOLD {
+		return
+	}
+
+	socket.snd.inRecovery = true
+	socket.snd.recover = socket.snd.NXT
+	socket.snd.highRxt = socket.snd.UNA
+	socket.snd.cc.OnLoss(&socket.snd)
+	socket.retransmitHole()
+}
+
+// Returns the RTT and delivery rate measured from the most recently sent packet the ACK covers
+func cleanUpInFlightPackets(socket *NormalSocket, header *TCPHeader) AckSample {
 	// Remove acknowledged packets from in-flight list
 	//oldUNA := socket.snd.UNA
+	sample := AckSample{Time: time.Now()}
+	acked := false
 	socket.snd.inFlightPackets.mutex.Lock()
 	newPackets := make([]InFlightPacket, 0)
 	for _, pkt := range socket.snd.inFlightPackets.packets {
-		if pkt.SeqNum+uint32(pkt.Length) > header.AckNum {
+		if pkt.SeqNum.Add(pkt.seqLength()).GT(header.AckNum) {
 			newPackets = append(newPackets, pkt)
 		} else {
-			// Use acknowledged packet for RTT calculation
+			acked = true
+			// Packets are kept in send order, so the last one acknowledged gives the freshest sample
+			sample.RTT = sample.Time.Sub(pkt.timeSent)
+			sample.DeliveryRate = socket.snd.sampleDelivery(pkt, sample.Time)
+			sample.PriorDelivered = pkt.delivered
+			// Use acknowledged packet for RTT calculation, unless timestamps measure it below
 			//if pkt.SeqNum == oldUNA {
-			socket.computeRTO(pkt.SeqNum, pkt.timeSent)
+			if !socket.timestamps {
+				socket.computeRTO(pkt.SeqNum, sample.Time)
+			}
 			socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
 			// We restart the timer here because we've recalculated the RTO
 			//}
@@ -418,14 +594,27 @@ func cleanUpInFlightPackets(socket *NormalSocket, header *TCPHeader) {
 	}
 	socket.snd.inFlightPackets.packets = newPackets
 	socket.snd.inFlightPackets.mutex.Unlock()
+
+	// The TSecr names the transmission this ACK answers, so retransmissions don't make the sample ambiguous
+	if acked && socket.timestamps {
+		socket.sampleTimestampRTT(header)
+		socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
+	}
+	return sample
 }
 
-func handleFIN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
+func handleFIN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader, payload []byte) {
 	socket := entry.SocketStruct.(*NormalSocket)
 
+	// The FIN follows the segment's data, and only counts once everything before it has arrived
+	// Otherwise the data path already asked for what is missing, and the peer sends the FIN again
+	if header.SeqNum.Add(uint32(len(payload))) != socket.rcv.NXT {
+		return
+	}
+
 	// Update socket state
-	socket.rcv.NXT = header.SeqNum + 1
-	socket.rcv.WND = header.WindowSize
+	socket.rcv.NXT++
+	socket.snd.WND = socket.peerWindow(header)
 
 	// Send ACK
 	ackHeader := &TCPHeader{
@@ -435,8 +624,10 @@ func handleFIN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 		AckNum:     socket.rcv.NXT,
 		DataOffset: 5,
 		Flags:      TCP_ACK,
-		WindowSize: socket.rcv.WND,
+		WindowSize: socket.advertisedWindow(),
+		Options:    socket.segmentOptions(),
 	}
+	socket.ackSent()
 
 	packet := serializeTCPPacket(ackHeader, nil)
 	ts.sendPacket(entry.RemoteAddress, packet)
@@ -444,22 +635,31 @@ func handleFIN(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 	cleanUpInFlightPackets(socket, header)
 
 	// Update state depending on current state
-	if entry.State == TCP_ESTABLISHED {
+	switch entry.State {
+	case TCP_ESTABLISHED:
 		entry.State = TCP_CLOSE_WAIT
+	case TCP_FIN_WAIT_1:
+		// Simultaneous close, our FIN isn't acknowledged yet
+		entry.State = TCP_CLOSING
+	case TCP_FIN_WAIT_2:
+		enterTimeWait(ts, entry)
 	}
 
-	if entry.State == TCP_FIN_WAIT_2 {
-		entry.State = TCP_TIME_WAIT
-		// Now wait for 2 * MSL before transitioning to CLOSED
-		// time.Sleep(2 * MSL) This doesn't work obviously
-		go func() {
-			time.Sleep(2 * MSL)
-			entry.State = TCP_CLOSED
-			ts.VDeleteTableEntry(*entry)
-		}()
-	}
+	// If we're in CLOSING or TIME_WAIT, we just resend the ACK but don't change the state
+}
 
-	// If we're in TIME_WAIT, we just resend the ACK but don't change the state
+func enterTimeWait(ts *TCPStack, entry *TCPTableEntry) {
+	entry.State = TCP_TIME_WAIT
+	// Now wait for 2 * MSL before transitioning to CLOSED
+	// time.Sleep(2 * MSL) This doesn't work obviously
+	socket := entry.SocketStruct.(*NormalSocket)
+	go func() {
+		time.Sleep(2 * MSL)
+		socket.mutex.Lock()
+		entry.State = TCP_CLOSED
+		socket.mutex.Unlock()
+		ts.VDeleteTableEntry(entry)
+	}()
 }
 
 func handleClosingACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
@@ -468,30 +668,49 @@ func handleClosingACK(ts *TCPStack, entry *TCPTableEntry, header *TCPHeader) {
 
 	// Update socket state
 	// socket.rcv.NXT = header.SeqNum + 1
-	socket.rcv.WND = header.WindowSize
+	socket.snd.WND = socket.peerWindow(header)
 
 	// Clean up in-flight packets
 	cleanUpInFlightPackets(socket, header)
 
+	// Until our FIN is acknowledged the timer keeps running to resend it
+	if !socket.finAcked() {
+		return
+	}
+
 	// We stop the timer since we're done sending data, and no further ACKs are expected
 	socket.snd.RTOtimer.Stop()
 
 	// Update state depending on current state
-	if entry.State == TCP_FIN_WAIT_1 {
+	switch entry.State {
+	case TCP_FIN_WAIT_1:
 		entry.State = TCP_FIN_WAIT_2
-	}
-	// We won't handle closing because that's for simultaneous close, which we don't support
-	if entry.State == TCP_LAST_ACK {
+	case TCP_CLOSING:
+		enterTimeWait(ts, entry)
+	case TCP_LAST_ACK:
 		entry.State = TCP_CLOSED
 		// Remove the TCB
-		ts.VDeleteTableEntry(*entry)
+		ts.VDeleteTableEntry(entry)
+	}
+}
+
+// Reports whether the peer has acknowledged our FIN
+func (socket *NormalSocket) finAcked() bool {
+	socket.snd.inFlightPackets.mutex.Lock()
+	defer socket.snd.inFlightPackets.mutex.Unlock()
+
+	for _, packet := range socket.snd.inFlightPackets.packets {
+		if packet.flags&TCP_FIN != 0 {
+			return false
+		}
 	}
+	return true
 }
 
 func handleRST(ts *TCPStack, entry *TCPTableEntry) {
 	// Immediately terminate connection, skip close state machine
 	entry.State = TCP_CLOSED
-	ts.VDeleteTableEntry(*entry)
+	ts.VDeleteTableEntry(entry)
 }
 
 // Event                    State (A)   State (B)
@@ -502,6 +721,11 @@ func handleRST(ts *TCPStack, entry *TCPTableEntry) {
 // A waits in TIME_WAIT     TIME_WAIT   CLOSED
 // A transitions to CLOSED  CLOSED      CLOSED
 
+// Simultaneous close:
+// A and B send FIN         FIN_WAIT_1  FIN_WAIT_1
+// Each gets the other FIN  CLOSING     CLOSING
+// Each gets the ACK        TIME_WAIT   TIME_WAIT
+
 // Other state changes:
 // After sending first FIN: A goes from ESTABLISHED to FIN_WAIT_1
 // After sending FIN in CLOSE_WAIT: A goes to LAST_ACK
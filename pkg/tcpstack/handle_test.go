@@ -0,0 +1,87 @@
+package tcpstack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Watches both ends of the connection between portA on a and portB on b until both reach want
+func watchBoth(a, b *testHost, portA, portB uint16, want TCPState) (statesA, statesB []TCPState) {
+	done := make(chan struct{})
+	go func() {
+		statesB = watchStates(b, portB, a.addr, portA, want)
+		close(done)
+	}()
+	statesA = watchStates(a, portA, b.addr, portB, want)
+	<-done
+	return statesA, statesB
+}
+
+// Drops the ESTABLISHED a watch may see before the close gets going
+func trimEstablished(states []TCPState) []TCPState {
+	if len(states) > 0 && states[0] == TCP_ESTABLISHED {
+		return states[1:]
+	}
+	return states
+}
+
+func checkStates(t *testing.T, host string, got, want []TCPState) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s went through states %v, want %v", host, got, want)
+	}
+}
+
+// Both ends open at once, each SYN reaches a socket in SYN_SENT (RFC 9293 figure 7)
+// The link delay keeps both SYNs in flight together, and each state lasts long enough to be seen
+func TestSimultaneousOpen(t *testing.T) {
+	a, b := newTestPair(t, &testLink{delay: 20 * time.Millisecond})
+
+	// Both stacks hand out the same first ephemeral port, so each connects to the port the other connects from
+	port := a.tcp.nextPort
+	errs := make(chan error, 2)
+	clientA, clientB := &NormalSocket{}, &NormalSocket{}
+	go func() { errs <- clientA.VConnect(a.tcp, b.addr, port) }()
+	go func() { errs <- clientB.VConnect(b.tcp, a.addr, port) }()
+
+	statesA, statesB := watchBoth(a, b, port, port, TCP_ESTABLISHED)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []TCPState{TCP_SYN_SENT, TCP_SYN_RECEIVED, TCP_ESTABLISHED}
+	checkStates(t, "a", statesA, want)
+	checkStates(t, "b", statesB, want)
+
+	// The connection the handshake built carries data both ways
+	if got := transfer(t, clientA, clientB, []byte("from a")); string(got) != "from a" {
+		t.Errorf("b received %q", got)
+	}
+	if got := transfer(t, clientB, clientA, []byte("from b")); string(got) != "from b" {
+		t.Errorf("a received %q", got)
+	}
+}
+
+// Both ends close at once, each FIN reaches a socket in FIN_WAIT_1 (RFC 9293 figure 13)
+func TestSimultaneousClose(t *testing.T) {
+	a, b := newTestPair(t, &testLink{delay: 20 * time.Millisecond})
+	client, server := connectPair(t, a, b, 80)
+
+	errs := make(chan error, 2)
+	go func() { errs <- client.VClose() }()
+	go func() { errs <- server.VClose() }()
+
+	statesClient, statesServer := watchBoth(a, b, client.LocalPort, server.LocalPort, TCP_TIME_WAIT)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []TCPState{TCP_FIN_WAIT_1, TCP_CLOSING, TCP_TIME_WAIT}
+	checkStates(t, "client", trimEstablished(statesClient), want)
+	checkStates(t, "server", trimEstablished(statesServer), want)
+}
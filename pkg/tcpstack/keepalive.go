@@ -0,0 +1,154 @@
+package tcpstack
+
+import (
+	"errors"
+	"time"
+)
+
+// TCP keepalive (RFC 1122 section 4.2.3.6)
+// Once an established connection has been idle for the idle time, we send a probe every interval:
+// an empty segment one byte below SND.NXT, which the peer can only answer with an ACK. Once count
+// probes in a row go unanswered the peer is considered gone and the connection is torn down
+
+// Returned by VRead and VWrite on a connection torn down because keepalive probes went unanswered
+var ErrKeepaliveTimeout = errors.New("connection timed out: keepalive probes unanswered")
+
+// Keepalive settings, an Idle of 0 turns keepalive off
+type KeepaliveConfig struct {
+	Idle     time.Duration // Time without hearing from the peer before the first probe
+	Interval time.Duration // Time between unanswered probes
+	Count    int           // Unanswered probes before the connection is dropped
+}
+
+func (config KeepaliveConfig) enabled() bool {
+	return config.Idle > 0 && config.Interval > 0 && config.Count > 0
+}
+
+// Sets the keepalive settings given to sockets created from now on
+func (ts *TCPStack) SetDefaultKeepalive(config KeepaliveConfig) {
+	ts.keepalive = config
+}
+
+// Sets this socket's keepalive settings, restarting the idle time
+func (socket *NormalSocket) SetKeepalive(config KeepaliveConfig) {
+	socket.keepaliveMutex.Lock()
+	defer socket.keepaliveMutex.Unlock()
+
+	socket.keepalive = config
+	socket.keepaliveProbes = 0
+	if socket.keepaliveTimer != nil {
+		socket.keepaliveTimer.Stop()
+		socket.keepaliveTimer = nil
+	}
+	if config.enabled() {
+		socket.keepaliveTimer = time.AfterFunc(config.Idle, socket.keepaliveTick)
+	}
+}
+
+// Stops the keepalive timer for good, once the connection has left the table
+func (socket *NormalSocket) stopKeepalive() {
+	socket.keepaliveMutex.Lock()
+	defer socket.keepaliveMutex.Unlock()
+
+	if socket.keepaliveTimer != nil {
+		socket.keepaliveTimer.Stop()
+		socket.keepaliveTimer = nil
+	}
+}
+
+// Records that we heard from the peer, which answers any outstanding probes
+func (socket *NormalSocket) touch() {
+	socket.keepaliveMutex.Lock()
+	defer socket.keepaliveMutex.Unlock()
+
+	socket.lastActive = time.Now()
+	socket.keepaliveProbes = 0
+}
+
+// Runs when the keepalive timer fires, probing or dropping the connection if it has been idle long enough
+func (socket *NormalSocket) keepaliveTick() {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	// The timer may outlive the connection
+	entry, err := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
+	if err != nil || entry.SocketStruct != Socket(socket) {
+		return
+	}
+
+	socket.keepaliveMutex.Lock()
+	defer socket.keepaliveMutex.Unlock()
+
+	config := socket.keepalive
+	if !config.enabled() || socket.keepaliveTimer == nil {
+		// Turned off while the timer was firing
+		return
+	}
+
+	// Only idle established connections are probed, anything else waits for another idle period
+	// Data in flight isn't idle, the retransmission timer already notices a dead peer there
+	busy := socket.snd.inFlightPackets.length() > 0 || socket.snd.buf.Length() > 0
+	if entry.State != TCP_ESTABLISHED || busy {
+		socket.keepaliveTimer.Reset(config.Idle)
+		return
+	}
+
+	idle := time.Since(socket.lastActive)
+	if socket.keepaliveProbes == 0 && idle < config.Idle {
+		socket.keepaliveTimer.Reset(config.Idle - idle)
+		return
+	}
+
+	if socket.keepaliveProbes >= config.Count {
+		socket.keepaliveTimer = nil
+		// abort takes the table lock and wakes readers, so it runs on its own
+		go socket.abort(ErrKeepaliveTimeout)
+		return
+	}
+
+	socket.keepaliveProbes++
+	socket.sendKeepaliveProbe()
+	socket.keepaliveTimer.Reset(config.Interval)
+}
+
+// Sends an empty segment with an already acknowledged sequence number, so the peer answers with an ACK
+func (socket *NormalSocket) sendKeepaliveProbe() error {
+	header := &TCPHeader{
+		SourcePort: socket.LocalPort,
+		DestPort:   socket.RemotePort,
+		SeqNum:     socket.snd.NXT - 1,
+		AckNum:     socket.rcv.NXT,
+		DataOffset: 5,
+		Flags:      TCP_ACK,
+		WindowSize: socket.advertisedWindow(),
+		Options:    socket.segmentOptions(),
+	}
+
+	packet := serializeTCPPacket(header, nil)
+	return socket.tcpStack.sendPacket(socket.RemoteAddress, packet)
+}
+
+// Tears the connection down without a closing handshake
+// Callers blocked in VRead or VWrite, and any later calls, get err
+func (socket *NormalSocket) abort(err error) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
+	socket.closeErr = err
+	socket.snd.RTOtimer.Stop()
+	socket.rcv.buf.CloseWithError(err)
+	socket.snd.buf.CloseWithError(err)
+
+	entry, findErr := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
+	if findErr == nil && entry.SocketStruct == Socket(socket) {
+		entry.State = TCP_CLOSED
+		socket.tcpStack.VDeleteTableEntry(entry)
+	}
+}
+
+// The error abort tore the connection down with, nil while it is open
+func (socket *NormalSocket) abortErr() error {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return socket.closeErr
+}
@@ -0,0 +1,43 @@
+package tcpstack
+
+import (
+	"testing"
+	"time"
+)
+
+// Closing the connection stops the keepalive timer instead of leaving it to fire for a missing entry
+func TestKeepaliveStopsOnClose(t *testing.T) {
+	a, b := newTestPair(t, &testLink{delay: 2 * time.Millisecond})
+	client, server := connectPair(t, a, b, 80)
+	server.SetKeepalive(KeepaliveConfig{Idle: 50 * time.Millisecond, Interval: 10 * time.Millisecond, Count: 3})
+
+	if err := client.VClose(); err != nil {
+		t.Fatal(err)
+	}
+	states := watchStates(b, server.LocalPort, server.RemoteAddress, server.RemotePort, TCP_CLOSE_WAIT)
+	if len(states) == 0 || states[len(states)-1] != TCP_CLOSE_WAIT {
+		t.Fatalf("server never took the FIN, states %v", states)
+	}
+	if err := server.VClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last ACK takes the server out of the table, the lookup then finds the listener
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entry, err := b.tcp.VFindTableEntry(server.LocalAddress, server.LocalPort, server.RemoteAddress, server.RemotePort)
+		if err != nil || entry.SocketStruct != Socket(server) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never left the table")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	server.keepaliveMutex.Lock()
+	defer server.keepaliveMutex.Unlock()
+	if server.keepaliveTimer != nil {
+		t.Fatal("keepalive timer still armed after the connection left the table")
+	}
+}
@@ -0,0 +1,213 @@
+package tcpstack
+
+import (
+	"bytes"
+	"fmt"
+	"ip-rip-in-peace/pkg/ipstack"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test harness: two hosts with real IP stacks talking over loopback UDP. The link is the TCP handler
+// each host registers, which delays and drops segments before handing them to the stack, so tests can
+// shape the path without touching the code under test
+
+// Path properties between the two test hosts
+type testLink struct {
+	delay time.Duration                                // One-way delay added to every segment
+	drop  func(header *TCPHeader, payload []byte) bool // Reports whether a segment is lost, nil loses none
+	mtuA  int                                          // Interface MTUs, 0 keeps the default
+	mtuB  int
+}
+
+// One end of the test link
+type testHost struct {
+	ip   *ipstack.IPStack
+	tcp  *TCPStack
+	addr netip.Addr
+
+	dataSegments atomic.Int64 // Segments with a payload that reached this host
+}
+
+type linkSegment struct {
+	src, dst netip.Addr
+	packet   []byte
+	at       time.Time
+}
+
+// Picks a UDP port nothing is listening on
+func freePort(t testing.TB) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Brings up a host from a generated lnx file, with the link in front of its TCP stack
+// The UDP sockets stay open for the rest of the test binary, the listeners have no way to stop
+func newTestHost(t testing.TB, link *testLink, addr, peer string, port, peerPort, mtu int) *testHost {
+	t.Helper()
+	mtuOption := ""
+	if mtu != 0 {
+		mtuOption = fmt.Sprintf(" mtu %d", mtu)
+	}
+	lnx := fmt.Sprintf("interface if0 %s/24 127.0.0.1:%d%s\nneighbor %s at 127.0.0.1:%d via if0\nrouting static\n",
+		addr, port, mtuOption, peer, peerPort)
+	file := filepath.Join(t.TempDir(), addr+".lnx")
+	if err := os.WriteFile(file, []byte(lnx), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := ipstack.InitNode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &testHost{ip: ip, tcp: InitTCPStack(ip), addr: netip.MustParseAddr(addr)}
+
+	// Segments go through one queue in arrival order, so the stack still sees them one at a time
+	queue := make(chan linkSegment, 4096)
+	go func() {
+		for segment := range queue {
+			time.Sleep(time.Until(segment.at))
+			host.tcp.HandlePacket(segment.src, segment.dst, segment.packet)
+		}
+	}()
+	ip.RegisterHandler(ipstack.TCP_PROTOCOL, func(packet *ipstack.IPPacket, _ *ipstack.IPStack) {
+		header, payload, err := ParseTCPHeader(packet.Payload)
+		if err != nil {
+			return
+		}
+		if link.drop != nil && link.drop(header, payload) {
+			return
+		}
+		if len(payload) > 0 {
+			host.dataSegments.Add(1)
+		}
+		queue <- linkSegment{packet.SourceIP, packet.DestinationIP, packet.Payload, time.Now().Add(link.delay)}
+	})
+
+	for _, iface := range ip.Interfaces {
+		go ipstack.InterfaceListen(iface, ip)
+	}
+	return host
+}
+
+// Brings up two hosts joined by link
+func newTestPair(t testing.TB, link *testLink) (a, b *testHost) {
+	t.Helper()
+	portA, portB := freePort(t), freePort(t)
+	a = newTestHost(t, link, "10.0.0.1", "10.0.0.2", portA, portB, link.mtuA)
+	b = newTestHost(t, link, "10.0.0.2", "10.0.0.1", portB, portA, link.mtuB)
+	return a, b
+}
+
+// Drops about rate of the segments that carry data, the handshake and bare ACKs always get through
+// Seeded, so a run loses the same segments each time the senders behave the same
+func lossyDrop(rate float64, seed int64) func(*TCPHeader, []byte) bool {
+	var mutex sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return func(header *TCPHeader, payload []byte) bool {
+		if len(payload) == 0 {
+			return false
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return rng.Float64() < rate
+	}
+}
+
+// Opens a connection from a to b on port and returns both ends
+func connectPair(t testing.TB, a, b *testHost, port uint16) (client, server *NormalSocket) {
+	t.Helper()
+	listener := VListen(b.tcp, port)
+	accepted := make(chan *NormalSocket, 1)
+	go func() { accepted <- listener.VAccept() }()
+
+	client = &NormalSocket{}
+	if err := client.VConnect(a.tcp, b.addr, port); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was never accepted")
+	}
+	return client, server
+}
+
+// Writes data on one end and reads it back from the other, returning what arrived
+func transfer(t testing.TB, from, to *NormalSocket, data []byte) []byte {
+	t.Helper()
+	received := make(chan []byte, 1)
+	go func() {
+		var got bytes.Buffer
+		buf := make([]byte, 64*1024)
+		for got.Len() < len(data) {
+			n, err := to.VRead(buf)
+			if err != nil {
+				break
+			}
+			got.Write(buf[:n])
+		}
+		received <- got.Bytes()
+	}()
+
+	if err := from.VWrite(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		return got
+	case <-time.After(60 * time.Second):
+		t.Fatal("transfer didn't finish")
+		return nil
+	}
+}
+
+// Polls the state of the connection from localPort to remote until it reaches want, returning every
+// state seen along the way. Polling can miss a state that lasts less than the interval, so tests give
+// the link enough delay that each one lasts at least a round trip. Safe to run off the test goroutine
+func watchStates(host *testHost, localPort uint16, remote netip.Addr, remotePort uint16, want TCPState) []TCPState {
+	var states []TCPState
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		state := TCP_LISTEN
+		if entry, err := host.tcp.VFindTableEntry(host.addr, localPort, remote, remotePort); err == nil {
+			state = entry.state()
+		}
+		if state != TCP_LISTEN && (len(states) == 0 || states[len(states)-1] != state) {
+			states = append(states, state)
+			if state == want {
+				return states
+			}
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	return states
+}
+
+// Reads connection state the packet handler and timers may be changing
+func locked[T any](socket *NormalSocket, read func() T) T {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return read()
+}
+
+// Test data that shows where a byte landed if it arrives out of place
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
@@ -11,7 +11,7 @@ func VListen(tcpStack *TCPStack, localPort uint16) *ListenSocket {
 		acceptQueue: make(chan *NormalSocket, 10), // Buffer size of 10
 	}
 
-	tcpStack.VInsertTableEntry(TCPTableEntry{
+	tcpStack.VInsertTableEntry(&TCPTableEntry{
 		LocalAddress: netip.AddrFrom4([4]byte{0, 0, 0, 0}),
 		LocalPort: localPort,
 		RemoteAddress: netip.AddrFrom4([4]byte{0, 0, 0, 0}),
@@ -0,0 +1,64 @@
+package tcpstack
+
+import (
+	"ip-rip-in-peace/pkg/ipstack"
+	"net/netip"
+	"sync"
+)
+
+// Segments to one of our own addresses
+// The IP stack delivers these on the sending goroutine, which would run the peer socket's handler, and
+// then ours again for its reply, while we still hold our socket's mutex. They go through a queue
+// instead, delivered in order from a goroutine of their own
+
+type loopbackSegment struct {
+	src, dst netip.Addr
+	data     []byte
+}
+
+type loopbackQueue struct {
+	mutex    sync.Mutex
+	segments []loopbackSegment
+	signal   chan struct{} // Wakes the delivering goroutine, see deliverLoopback
+}
+
+// Reports whether dst is one of our own interface addresses
+func (ts *TCPStack) isLocalAddress(dst netip.Addr) bool {
+	for _, iface := range ts.ipStack.Interfaces {
+		if iface.IPAddr == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a segment for one of our own addresses, never blocking the sender
+func (ts *TCPStack) sendLoopback(src, dst netip.Addr, data []byte) {
+	ts.loopback.mutex.Lock()
+	ts.loopback.segments = append(ts.loopback.segments, loopbackSegment{src, dst, data})
+	ts.loopback.mutex.Unlock()
+
+	select {
+	case ts.loopback.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Hands queued segments to the IP stack, runs for the life of the stack
+func (ts *TCPStack) deliverLoopback() {
+	for range ts.loopback.signal {
+		for {
+			ts.loopback.mutex.Lock()
+			segments := ts.loopback.segments
+			ts.loopback.segments = nil
+			ts.loopback.mutex.Unlock()
+
+			if len(segments) == 0 {
+				break
+			}
+			for _, segment := range segments {
+				ts.ipStack.SendIPFrom(segment.src, segment.dst, ipstack.TCP_PROTOCOL, 16, segment.data)
+			}
+		}
+	}
+}
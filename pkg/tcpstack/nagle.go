@@ -0,0 +1,31 @@
+package tcpstack
+
+// Nagle's algorithm (RFC 896, RFC 1122 section 4.2.3.4)
+// While data is unacknowledged, small writes collect in the send buffer instead of each going out
+// as its own tiny segment. They go out once they fill a segment or everything in flight is acknowledged
+
+// Turns Nagle's algorithm off (true) or back on (false), like TCP_NODELAY
+func (socket *NormalSocket) SetNoDelay(noDelay bool) {
+	socket.mutex.Lock()
+	socket.noDelay = noDelay
+	socket.mutex.Unlock()
+	if noDelay {
+		// Anything held back can go right away
+		socket.kickSender()
+	}
+}
+
+// Reports whether buffered data smaller than a full segment should wait for the outstanding data to be acknowledged
+func (socket *NormalSocket) nagleHold(buffered, fullSegment int) bool {
+	return !socket.noDelay && buffered < fullSegment && socket.snd.NXT != socket.snd.UNA
+}
+
+// Sends data that Nagle held back, from its own goroutine so the packet handler never waits on the window
+// At most one of these is queued behind a running sender
+func (socket *NormalSocket) kickSender() {
+	if socket.snd.buf.Length() == 0 || !socket.snd.sendPending.CompareAndSwap(false, true) {
+		return
+	}
+
+	go socket.trySendData()
+}
@@ -0,0 +1,89 @@
+package tcpstack
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Sends many small writes and returns how many data segments the receiver saw
+func smallWriteSegments(t *testing.T, noDelay bool) int64 {
+	const writes, size = 50, 10
+
+	a, b := newTestPair(t, &testLink{delay: 10 * time.Millisecond})
+	client, server := connectPair(t, a, b, 80)
+	client.SetNoDelay(noDelay)
+
+	received := make(chan []byte, 1)
+	go func() {
+		var got bytes.Buffer
+		buf := make([]byte, writes*size)
+		for got.Len() < writes*size {
+			n, err := server.VRead(buf)
+			if err != nil {
+				break
+			}
+			got.Write(buf[:n])
+		}
+		received <- got.Bytes()
+	}()
+
+	data := pattern(writes * size)
+	for i := 0; i < writes; i++ {
+		if err := client.VWrite(data[i*size : (i+1)*size]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Fatalf("received %d bytes that don't match what was written", len(got))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("small writes never all arrived")
+	}
+	return b.dataSegments.Load()
+}
+
+func TestNagleCoalescesSmallWrites(t *testing.T) {
+	nagle := smallWriteSegments(t, false)
+	noDelay := smallWriteSegments(t, true)
+	t.Logf("50 writes of 10 bytes: %d segments with Nagle, %d with nodelay", nagle, noDelay)
+
+	// Writes are much faster than the round trip, so Nagle sends the first and coalesces the rest
+	// behind it, while nodelay sends every write on its own
+	if noDelay < 45 {
+		t.Errorf("nodelay sent %d segments for 50 writes, want one per write", noDelay)
+	}
+	if nagle > 10 {
+		t.Errorf("Nagle sent %d segments for 50 writes, want them coalesced", nagle)
+	}
+}
+
+// Data Nagle is holding when the connection closes goes out ahead of the FIN
+func TestCloseFlushesHeldData(t *testing.T) {
+	a, b := newTestPair(t, &testLink{delay: 20 * time.Millisecond})
+	client, server := connectPair(t, a, b, 80)
+
+	// The first write goes out, the next two wait behind it for an ACK that is still a round trip away
+	for _, chunk := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := client.VWrite([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.VClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	states := watchStates(b, server.LocalPort, server.RemoteAddress, server.RemotePort, TCP_CLOSE_WAIT)
+	if len(states) == 0 || states[len(states)-1] != TCP_CLOSE_WAIT {
+		t.Fatalf("server never saw the FIN, states %v", states)
+	}
+
+	// The server can't read once it is in CLOSE_WAIT, so look at what reached its receive buffer
+	got := make([]byte, server.rcv.buf.Length())
+	server.rcv.buf.TryRead(got)
+	if string(got) != "aaaabbbbcccc" {
+		t.Fatalf("server received %q before the FIN, want %q", got, "aaaabbbbcccc")
+	}
+}
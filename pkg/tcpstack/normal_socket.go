@@ -15,21 +15,53 @@ func (ns *NormalSocket) GetSID() int {
 
 func (ns *NormalSocket) VClose() error {
 	// Check if connection is in the right state
-	table_entry, _ := ns.tcpStack.VFindTableEntry(ns.LocalAddress, ns.LocalPort, ns.RemoteAddress, ns.RemotePort)
-	if table_entry.State != TCP_ESTABLISHED && table_entry.State != TCP_CLOSE_WAIT {
+	table_entry, err := ns.tcpStack.VFindTableEntry(ns.LocalAddress, ns.LocalPort, ns.RemoteAddress, ns.RemotePort)
+	if err != nil || (table_entry.state() != TCP_ESTABLISHED && table_entry.state() != TCP_CLOSE_WAIT) {
 		return fmt.Errorf("connection not established")
 	}
 
-	// Send FIN packet
+	// Everything written goes out before the FIN takes the next sequence number, including what Nagle
+	// is holding back. Holding the send mutex keeps a queued sender from slipping data in after the FIN
+	// This happens before the state changes, since ACKs for the data are only processed while established
+	ns.snd.sendMutex.Lock()
+	defer ns.snd.sendMutex.Unlock()
+	for {
+		if err := ns.sendBuffered(true); err != nil {
+			return err
+		}
+		if ns.snd.buf.Length() == 0 {
+			break
+		}
+		// The pacing rate held the rest back, wait for its timer without keeping its sender out
+		ns.snd.sendMutex.Unlock()
+		ns.snd.waitForPacing()
+		ns.snd.sendMutex.Lock()
+	}
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	// Update state before the FIN goes out, so a FIN crossing ours finds us in FIN_WAIT_1
+	// The peer's FIN may have moved us to CLOSE_WAIT while the data went out
+	if table_entry.State == TCP_ESTABLISHED {
+		table_entry.State = TCP_FIN_WAIT_1
+	} else if table_entry.State == TCP_CLOSE_WAIT {
+		table_entry.State = TCP_LAST_ACK
+	} else {
+		return fmt.Errorf("connection not established")
+	}
+
+	// Send FIN packet, it takes up one sequence number after the data
 	//fmt.Println("ack num: ", ns.rcv.NXT)
 	header := &TCPHeader{
 		SourcePort: ns.LocalPort,
 		DestPort:   ns.RemotePort,
-		SeqNum:     ns.SeqNum,
+		SeqNum:     ns.snd.NXT,
 		AckNum:     ns.rcv.NXT,
 		DataOffset: 5,
-		Flags:      TCP_FIN,
-		WindowSize: ns.rcv.WND,
+		Flags:      TCP_FIN | TCP_ACK,
+		WindowSize: ns.advertisedWindow(),
+		Options:    ns.segmentOptions(),
 	}
 
 	// Manage the RTO timer (if there are inflightpackets, it is running and we leave it, if not, we reset)
@@ -41,29 +73,17 @@ func (ns *NormalSocket) VClose() error {
 	ns.snd.inFlightPackets.mutex.Lock()
 	ns.snd.inFlightPackets.packets = append(ns.snd.inFlightPackets.packets, InFlightPacket{
 		data:     nil,
-		SeqNum:   ns.SeqNum,
+		SeqNum:   header.SeqNum,
 		Length:   0,
 		timeSent: time.Now(),
-		flags:    TCP_FIN,
+		flags:    header.Flags,
 	})
 	ns.snd.inFlightPackets.mutex.Unlock()
 	//fmt.Println("unlocked packets mutex")
+	ns.snd.NXT++
 
 	packet := serializeTCPPacket(header, nil)
-	err := ns.tcpStack.sendPacket(ns.RemoteAddress, packet)
-	if err != nil {
-		return err
-	}
-
-	// Update state to FIN_WAIT_1
-	table_entry, _ = ns.tcpStack.VFindTableEntry(ns.LocalAddress, ns.LocalPort, ns.RemoteAddress, ns.RemotePort)
-	if table_entry.State == TCP_ESTABLISHED {
-		table_entry.State = TCP_FIN_WAIT_1
-	} else if table_entry.State == TCP_CLOSE_WAIT {
-		table_entry.State = TCP_LAST_ACK
-	}
-
-	return nil
+	return ns.tcpStack.sendPacket(ns.RemoteAddress, packet)
 }
 
 func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, remotePort uint16) error {
@@ -82,26 +102,33 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 
 	// Initialize send/receive state
 	ns.snd = SND{
-		buf: ringbuffer.New(int(BUFFER_SIZE)),
+		buf: ringbuffer.New(int(tcpStack.bufferSize)),
 		ISS: ns.SeqNum,
 		UNA: ns.SeqNum,
 		NXT: ns.SeqNum + 1, // +1 for SYN
-		WND: BUFFER_SIZE,
+		WND: tcpStack.bufferSize,
+		MSS: DEFAULT_MSS, // Until the SYN-ACK tells us the peer's
 		//RTOtimer:      time.NewTimer(1 * time.Second), // This is the default value
 		calculatedRTO:   1 * time.Second,
 		SRTT:            0,
 		RTTVAR:          0,
 		retransmissions: 0,
+		ackSignal:       make(chan struct{}, 1),
+		pacingSignal:    make(chan struct{}, 1),
 	}
 	ns.snd.buf.SetBlocking(true)
 	ns.snd.RTOtimer = time.NewTimer(ns.snd.calculatedRTO)
 	ns.snd.RTOtimer.Stop()
+	tcpStack.initCongestionControl(&ns.snd)
 
 	ns.rcv = RCV{
-		buf: ringbuffer.New(int(BUFFER_SIZE)),
-		WND: BUFFER_SIZE,
+		buf:               ringbuffer.New(int(tcpStack.bufferSize)),
+		WND:               tcpStack.bufferSize,
+		delayedAckTimeout: tcpStack.delayedAckTimeout,
 	}
 	ns.rcv.buf.SetBlocking(true)
+	ns.rcvWindowShift = windowShift(tcpStack.bufferSize)
+	ns.SetKeepalive(tcpStack.keepalive)
 
 	// Set local address to first interface address (for now)
 	for _, iface := range tcpStack.ipStack.Interfaces {
@@ -110,7 +137,7 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 	}
 
 	// Create new TCP table entry
-	entry := TCPTableEntry{
+	entry := &TCPTableEntry{
 		LocalAddress:  ns.LocalAddress,
 		LocalPort:     ns.LocalPort,
 		RemoteAddress: remoteAddress,
@@ -119,6 +146,8 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 		SocketStruct:  ns,
 	}
 
+	// The SYN-ACK and the retransmission timer wait until the SYN is on its way
+	ns.mutex.Lock()
 	tcpStack.VInsertTableEntry(entry)
 
 	// Send SYN packet with our window size
@@ -128,7 +157,8 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 		SeqNum:     ns.SeqNum,
 		DataOffset: 5,
 		Flags:      TCP_SYN,
-		WindowSize: ns.rcv.WND,
+		WindowSize: synWindow(ns.rcv.WND),
+		Options:    ns.synOptions(nil),
 	}
 
 	// Add to in-flight packets
@@ -139,6 +169,8 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 		Length:   0,
 		timeSent: time.Now(),
 		flags:    TCP_SYN,
+		windowFlags: header.WindowSize,
+		options:  header.Options,
 	})
 	ns.snd.inFlightPackets.mutex.Unlock()
 
@@ -147,6 +179,7 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 
 	packet := serializeTCPPacket(header, nil)
 	err := tcpStack.sendPacket(remoteAddress, packet)
+	ns.mutex.Unlock()
 	if err != nil {
 		fmt.Println("Error sending SYN packet: ", err)
 		return err
@@ -164,6 +197,10 @@ func (ns *NormalSocket) VConnect(tcpStack *TCPStack, remoteAddress netip.Addr, r
 }
 
 func (socket *NormalSocket) VWrite(data []byte) error {
+	if err := socket.abortErr(); err != nil {
+		return err
+	}
+
 	// Check if connection is in the right state
 
 	table_entry, err := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
@@ -172,7 +209,7 @@ func (socket *NormalSocket) VWrite(data []byte) error {
 		return err
 	}
 
-	if table_entry.State != TCP_ESTABLISHED && table_entry.State != TCP_CLOSE_WAIT {
+	if state := table_entry.state(); state != TCP_ESTABLISHED && state != TCP_CLOSE_WAIT {
 		return fmt.Errorf("connection not established")
 	}
 
@@ -184,6 +221,13 @@ func (socket *NormalSocket) VWrite(data []byte) error {
 		if err != nil && err != ringbuffer.ErrIsFull && err != ringbuffer.ErrTooMuchDataToWrite {
 			return err
 		}
+		if n == 0 {
+			// The buffer is full and the pacing timer is sending from it, so wait for room
+			n, err = socket.snd.buf.Write(data)
+			if err != nil {
+				return err
+			}
+		}
 
 		// Try to send data
 		err = socket.trySendData()
@@ -214,14 +258,27 @@ func (socket *NormalSocket) sendRST() error {
 }
 
 func (socket *NormalSocket) trySendData() error {
+	// One sender at a time, whoever gets here sends everything buffered so far
+	socket.snd.sendMutex.Lock()
+	defer socket.snd.sendMutex.Unlock()
+	return socket.sendBuffered(false)
+}
+
+// Sends what is in the send buffer as the windows allow, the caller holds sendMutex
+// With flush set a final partial segment goes out right away instead of Nagle holding it
+// The socket's mutex is only held while a segment is put together, never while waiting for the window
+func (socket *NormalSocket) sendBuffered(flush bool) error {
+	socket.snd.sendPending.Store(false)
+
 	// Changed this to a for loop to send larger packets, may need to revise this
 	for socket.snd.buf.Length() > 0 {
 		// bufferSpace := socket.snd.buf.Length()
+		socket.mutex.Lock()
 
-		// Free window space is size of receiver buffer - amount of data in flight
+		// Free window space is the smaller of the receiver's window and our congestion window, minus the data in flight
 		// Calculate data in flight using pointers
-		dataInFlight := socket.snd.NXT - socket.snd.UNA
-		freeWindowSpace := socket.snd.WND - uint16(dataInFlight)
+		dataInFlight := int(socket.snd.NXT.Sub(socket.snd.UNA))
+		freeWindowSpace := min(int(socket.snd.WND), int(socket.snd.cwnd)) - dataInFlight
 
 		//fmt.Println("In flight packets: ", len(socket.snd.inFlightPackets))
 		// if bufferSpace == 0{ //&& //len(socket.snd.inFlightPackets) == 0 { this is not needed, since retransmissions should be handled separately in a go routine
@@ -231,16 +288,39 @@ func (socket *NormalSocket) trySendData() error {
 
 		if socket.snd.WND > 0 {
 			if freeWindowSpace <= 0 {
+				// Sleep until an ACK opens the window rather than spinning
+				socket.mutex.Unlock()
+				socket.snd.waitForAck()
 				continue
 				// return nil
 			}
-			maxSendSize := min(int(freeWindowSpace), MAX_TCP_PAYLOAD)
+			// The MSS doesn't count options, so they come out of the payload (RFC 6691)
+			options := socket.segmentOptions()
+			if len(options.marshal()) >= int(socket.snd.MSS) {
+				// Tiny MSS, leave the SACK blocks to the pure ACKs
+				options.SACK = nil
+			}
+			fullSegment := int(socket.snd.MSS) - len(options.marshal())
+			if !flush && socket.nagleHold(socket.snd.buf.Length(), fullSegment) {
+				// The ACK for the outstanding data sends this, see kickSender
+				socket.mutex.Unlock()
+				return nil
+			}
+			maxSendSize := min(int(freeWindowSpace), fullSegment)
+
+			if wait := socket.snd.pacingDelay(); wait > 0 {
+				// The pacing timer sends the rest, so the send mutex isn't held while waiting
+				socket.schedulePacedSend(wait)
+				socket.mutex.Unlock()
+				return nil
+			}
 
 			sendData := make([]byte, maxSendSize)
 			//  socket.snd.buf.SetBlocking(true) // We don't want blocking here, since we should never be trying to send more than the buffer has
 			n, err := socket.snd.buf.Read(sendData)
 			// This will return an error if there's nothing in the buffer
 			if err != nil {
+				socket.mutex.Unlock()
 				return err
 			}
 
@@ -251,39 +331,50 @@ func (socket *NormalSocket) trySendData() error {
 				AckNum:     socket.rcv.NXT,
 				DataOffset: 5,
 				Flags:      TCP_ACK,
-				WindowSize: uint16(socket.rcv.buf.Free()), // Our current receive window
+				WindowSize: socket.advertisedWindow(), // Our current receive window
+				Options:    options,
 				Checksum:   0,
 			}
 
 
-			// Send data packet
-			packet := serializeTCPPacket(header, sendData[:n])
-			err = socket.tcpStack.sendPacket(socket.RemoteAddress, packet)
-			if err != nil {
-				return err
-			}
-			
 			// We figure out if inflight packets is empty here to know if we should reset the RTO timer
 			if len(socket.snd.inFlightPackets.packets) == 0 {
 				socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
 			}
 
-			// Add it to the inflight packets
-			socket.snd.inFlightPackets.mutex.Lock()
-			socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, InFlightPacket{
+			// Add it to the inflight packets and move NXT before sending, since the ACK can come back
+			// before sendPacket returns
+			inFlight := InFlightPacket{
 				data:     sendData[:n],
 				SeqNum:   socket.snd.NXT,
 				Length:   uint16(n),
 				timeSent: time.Now(),
 				flags:    TCP_ACK,
-			})
+			}
+			socket.snd.inFlightPackets.mutex.Lock()
+			socket.snd.stampDelivery(&inFlight)
+			socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, inFlight)
 			socket.snd.inFlightPackets.mutex.Unlock()
 
 			// Update send buffer sequence number
-			socket.snd.NXT += uint32(n)
+			socket.snd.NXT = socket.snd.NXT.Add(uint32(n))
+			socket.snd.segmentsSent++
+			// The data carries our ACK, so there's no need for a separate one
+			socket.ackSent()
+
+			// Send data packet
+			packet := serializeTCPPacket(header, sendData[:n])
+			err = socket.tcpStack.sendPacket(socket.RemoteAddress, packet)
+			if err != nil {
+				socket.mutex.Unlock()
+				return err
+			}
+			socket.snd.paced(n)
+			socket.mutex.Unlock()
 
 		} else if socket.snd.WND == 0 {
 			// Send zero window probe
+			socket.mutex.Unlock()
 			err := socket.sendZeroWindowProbe()
 			if err != nil {
 				return err
@@ -294,12 +385,16 @@ func (socket *NormalSocket) trySendData() error {
 }
 
 // New helper function for zero window probing
+// Takes the socket's mutex for each probe, and lets go of it while waiting for the answer
 func (socket *NormalSocket) sendZeroWindowProbe() error {
 	// Keep probing until either we get a non-zero window or hit retry limit
 	retries := 0
 	next_byte_data := make([]byte, 1)
 	socket.snd.buf.TryRead(next_byte_data) // Should always have data or we shouldn't be here
 
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+
 	for socket.snd.WND == 0 && retries < ZWP_RETRIES {
 		fmt.Println("Sending zero window probe")
 		header := &TCPHeader{
@@ -309,7 +404,8 @@ func (socket *NormalSocket) sendZeroWindowProbe() error {
 			AckNum:     socket.rcv.NXT,
 			DataOffset: 5,
 			Flags:      TCP_ACK,
-			WindowSize: uint16(socket.rcv.buf.Free()),
+			WindowSize: socket.advertisedWindow(),
+			Options:    socket.segmentOptions(),
 		}
 
 
@@ -323,18 +419,24 @@ func (socket *NormalSocket) sendZeroWindowProbe() error {
 		// socket.snd.NXT += 1
 		retries++
 
-		// Wait for response before sending next probe
-		time.Sleep(ZWP_PROBE_INTERVAL)
+		// Wait for response before sending next probe, waking early if the window opens
+		socket.mutex.Unlock()
+		select {
+		case <-socket.snd.ackSignal:
+		case <-time.After(ZWP_PROBE_INTERVAL):
+		}
+		socket.mutex.Lock()
 	}
 
 	if retries >= ZWP_RETRIES {
 		return fmt.Errorf("zero window probe max retries exceeded")
 	}
 
-	socket.snd.NXT++
 	fmt.Println("Window size: ", socket.snd.WND)
 
-	return nil
+	// A probe that found the window closed was dropped, so the byte goes out again as regular data,
+	// tracked and retransmitted like the rest. If the peer did take a probe, this copy is just a duplicate
+	return socket.sendDataPacket(next_byte_data)
 }
 
 // New helper function for sending data packets
@@ -346,7 +448,8 @@ func (socket *NormalSocket) sendDataPacket(data []byte) error {
 		AckNum:     socket.rcv.NXT,
 		DataOffset: 5,
 		Flags:      TCP_ACK,
-		WindowSize: uint16(socket.rcv.buf.Free()),
+		WindowSize: socket.advertisedWindow(),
+		Options:    socket.segmentOptions(),
 	}
 
 	fmt.Println("Seq num: ", socket.snd.NXT)
@@ -357,18 +460,24 @@ func (socket *NormalSocket) sendDataPacket(data []byte) error {
 		return err
 	}
 
-	// Track in-flight packet
-	socket.snd.inFlightPackets.mutex.Lock()
-	socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, InFlightPacket{
+	// Track in-flight packet, starting the RTO timer if it is the only one
+	inFlight := InFlightPacket{
 		data:     data,
 		SeqNum:   socket.snd.NXT,
 		Length:   uint16(len(data)),
 		timeSent: time.Now(),
 		flags:    TCP_ACK,
-	})
+	}
+	socket.snd.inFlightPackets.mutex.Lock()
+	if len(socket.snd.inFlightPackets.packets) == 0 {
+		socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
+	}
+	socket.snd.stampDelivery(&inFlight)
+	socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, inFlight)
 	socket.snd.inFlightPackets.mutex.Unlock()
 
-	socket.snd.NXT += uint32(len(data))
+	socket.snd.NXT = socket.snd.NXT.Add(uint32(len(data)))
+	socket.ackSent()
 	return nil
 }
 
@@ -389,9 +498,16 @@ func abs(x int64) int64 {
 }
 
 func (socket *NormalSocket) VRead(data []byte) (int, error) {
+	if err := socket.abortErr(); err != nil {
+		return 0, err
+	}
+
 	// Check if connection is in the right state
-	table_entry, _ := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
-	if table_entry.State != TCP_ESTABLISHED && table_entry.State != TCP_FIN_WAIT_1 && table_entry.State != TCP_FIN_WAIT_2 {
+	table_entry, err := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
+	if err != nil {
+		return 0, fmt.Errorf("connection not established")
+	}
+	if state := table_entry.state(); state != TCP_ESTABLISHED && state != TCP_FIN_WAIT_1 && state != TCP_FIN_WAIT_2 {
 		return 0, fmt.Errorf("connection not established")
 	}
 
@@ -402,7 +518,9 @@ func (socket *NormalSocket) VRead(data []byte) (int, error) {
 	}
 
 	// Update window
-	socket.rcv.WND = uint16(socket.rcv.buf.Free())
+	socket.mutex.Lock()
+	socket.rcv.WND = uint32(socket.rcv.buf.Free())
+	socket.mutex.Unlock()
 
 	return n, nil
 }
@@ -416,12 +534,13 @@ func (socket *NormalSocket) VSendFile(filename string) error {
 	defer file.Close()
 
 	fmt.Println("Sending file")
+	start := time.Now()
 
 	// Track total bytes sent
 	var totalBytesSent int64 = 0
 
 	// Read file into buffer
-	buffer := make([]byte, BUFFER_SIZE)
+	buffer := make([]byte, socket.snd.buf.Capacity())
 	for {
 		n, err := file.Read(buffer)
 		if err != nil && err != io.EOF {
@@ -445,12 +564,18 @@ func (socket *NormalSocket) VSendFile(filename string) error {
 		}
 	}
 
-	fmt.Printf("Sent %d total bytes\n", totalBytesSent)
+	// Throughput and retransmissions, to compare congestion control algorithms
+	elapsed := time.Since(start)
+	socket.mutex.Lock()
+	retransmitted := socket.snd.retransmitted
+	socket.mutex.Unlock()
+	fmt.Printf("Sent %d total bytes in %v (%.1f KB/s, %d retransmissions)\n", totalBytesSent, elapsed.Round(time.Millisecond),
+		float64(totalBytesSent)/1000/elapsed.Seconds(), retransmitted)
 	fmt.Println("Closing connection")
 	
-	// Close the connection after sending the file
+	// Close the connection after sending the file, once Nagle has nothing left buffered either
 	for {
-		if len(socket.snd.inFlightPackets.packets) == 0 {
+		if socket.snd.inFlightPackets.length() == 0 && socket.snd.buf.Length() == 0 {
 			err = socket.VClose()
 			if err != nil {
 				return fmt.Errorf("error closing connection after file transfer: %v", err)
@@ -473,7 +598,7 @@ func (socket *NormalSocket) VReceiveFile(filename string) error {
 	// Track total bytes received
 	var totalBytesReceived int64 = 0
 
-	buffer := make([]byte, BUFFER_SIZE)
+	buffer := make([]byte, socket.rcv.buf.Capacity())
 	for {
 		// Check if connection is closed before each read
 		table_entry, err := socket.tcpStack.VFindTableEntry(socket.LocalAddress, socket.LocalPort, socket.RemoteAddress, socket.RemotePort)
@@ -481,11 +606,13 @@ func (socket *NormalSocket) VReceiveFile(filename string) error {
 			return err
 		}
 
-		if table_entry.State == TCP_CLOSE_WAIT {
+		if table_entry.state() == TCP_CLOSE_WAIT {
 			break
 		}
 
 		if socket.rcv.buf.Length() == 0 {
+			// Yield instead of spinning so the packet handlers can run
+			time.Sleep(time.Millisecond)
 			continue
 		}
 		n, err := socket.VRead(buffer)
@@ -507,7 +634,7 @@ func (socket *NormalSocket) VReceiveFile(filename string) error {
 		}
 
 		// If we're in CLOSE_WAIT state, it means we've received FIN from the sender
-		if table_entry.State == TCP_CLOSE_WAIT {
+		if table_entry.state() == TCP_CLOSE_WAIT {
 			break
 		}
 	}
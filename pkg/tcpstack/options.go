@@ -0,0 +1,262 @@
+package tcpstack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// TCP option kinds
+const (
+	TCP_OPT_EOL            = 0
+	TCP_OPT_NOP            = 1
+	TCP_OPT_MSS            = 2
+	TCP_OPT_WINDOW_SCALE   = 3
+	TCP_OPT_SACK_PERMITTED = 4
+	TCP_OPT_SACK           = 5
+	TCP_OPT_TIMESTAMPS     = 8
+)
+
+// Lengths of the fixed-size options, including the kind and length bytes
+const (
+	TCP_OPT_MSS_LEN            = 4
+	TCP_OPT_WINDOW_SCALE_LEN   = 3
+	TCP_OPT_SACK_PERMITTED_LEN = 2
+	TCP_OPT_TIMESTAMPS_LEN     = 10
+)
+
+// A data offset of 15 words leaves 40 bytes for options after the fixed header
+const MAX_TCP_OPTIONS_LEN = 40
+
+// Most SACK blocks that fit in the option space
+const MAX_SACK_BLOCKS = 4
+
+// Largest window scale shift allowed by RFC 7323
+const MAX_WINDOW_SCALE = 14
+
+// MSS to assume when the peer's SYN doesn't carry one (RFC 9293)
+const DEFAULT_MSS = 536
+
+// A range of sequence numbers the receiver holds beyond its cumulative ACK, Right is one past the end
+type SACKBlock struct {
+	Left  SequenceNumber
+	Right SequenceNumber
+}
+
+// The options carried by a segment, zero values mean the option is absent
+type TCPOptions struct {
+	MSS uint16 // Largest segment the sender accepts, only on SYNs
+
+	// Shift applied to the sender's advertised windows, only on SYNs
+	HasWindowScale bool
+	WindowScale    uint8
+
+	SACKPermitted bool
+	SACK          []SACKBlock
+
+	// Sender's clock and the most recent clock value it received (RFC 7323)
+	HasTimestamps bool
+	TSVal         uint32
+	TSEcr         uint32
+}
+
+// Encodes the options, padded with NOPs to a multiple of four bytes
+// SACK blocks that don't fit next to the other options are left out, most recent first
+func (o *TCPOptions) marshal() []byte {
+	buf := make([]byte, 0, MAX_TCP_OPTIONS_LEN)
+
+	if o.MSS != 0 {
+		buf = append(buf, TCP_OPT_MSS, TCP_OPT_MSS_LEN)
+		buf = binary.BigEndian.AppendUint16(buf, o.MSS)
+	}
+
+	if o.HasWindowScale {
+		buf = append(buf, TCP_OPT_NOP, TCP_OPT_WINDOW_SCALE, TCP_OPT_WINDOW_SCALE_LEN, uint8(min(int(o.WindowScale), MAX_WINDOW_SCALE)))
+	}
+
+	// SACK-permitted shares its word with timestamps when both are present, as most stacks lay them out
+	if o.HasTimestamps {
+		if o.SACKPermitted {
+			buf = append(buf, TCP_OPT_SACK_PERMITTED, TCP_OPT_SACK_PERMITTED_LEN)
+		} else {
+			buf = append(buf, TCP_OPT_NOP, TCP_OPT_NOP)
+		}
+		buf = append(buf, TCP_OPT_TIMESTAMPS, TCP_OPT_TIMESTAMPS_LEN)
+		buf = binary.BigEndian.AppendUint32(buf, o.TSVal)
+		buf = binary.BigEndian.AppendUint32(buf, o.TSEcr)
+	} else if o.SACKPermitted {
+		buf = append(buf, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_SACK_PERMITTED, TCP_OPT_SACK_PERMITTED_LEN)
+	}
+
+	if len(o.SACK) > 0 {
+		// Two NOPs, kind and length, then eight bytes per block
+		room := (MAX_TCP_OPTIONS_LEN - len(buf) - 4) / 8
+		blocks := o.SACK[:min(min(len(o.SACK), MAX_SACK_BLOCKS), room)]
+		if len(blocks) > 0 {
+			buf = append(buf, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_SACK, uint8(2+8*len(blocks)))
+			for _, block := range blocks {
+				buf = binary.BigEndian.AppendUint32(buf, uint32(block.Left))
+				buf = binary.BigEndian.AppendUint32(buf, uint32(block.Right))
+			}
+		}
+	}
+
+	for len(buf)%4 != 0 {
+		buf = append(buf, TCP_OPT_NOP)
+	}
+	return buf
+}
+
+// Decodes the options area of a header
+// Unknown options are skipped, but a truncated option or a known option with the wrong length is an error
+func parseTCPOptions(data []byte) (TCPOptions, error) {
+	var options TCPOptions
+
+	if len(data) > MAX_TCP_OPTIONS_LEN {
+		return options, fmt.Errorf("options are %d bytes, at most %d allowed", len(data), MAX_TCP_OPTIONS_LEN)
+	}
+
+	for i := 0; i < len(data); {
+		kind := data[i]
+		if kind == TCP_OPT_EOL {
+			break
+		}
+		if kind == TCP_OPT_NOP {
+			i++
+			continue
+		}
+
+		// Every other option has a length byte covering the kind and length
+		if i+1 >= len(data) {
+			return options, fmt.Errorf("option %d is missing its length", kind)
+		}
+		length := int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			return options, fmt.Errorf("option %d has invalid length %d", kind, length)
+		}
+		value := data[i+2 : i+length]
+
+		switch kind {
+		case TCP_OPT_MSS:
+			if length != TCP_OPT_MSS_LEN {
+				return options, fmt.Errorf("MSS option has invalid length %d", length)
+			}
+			options.MSS = binary.BigEndian.Uint16(value)
+		case TCP_OPT_WINDOW_SCALE:
+			if length != TCP_OPT_WINDOW_SCALE_LEN {
+				return options, fmt.Errorf("window scale option has invalid length %d", length)
+			}
+			// RFC 7323 says to use the largest allowed shift when the peer asks for more
+			options.HasWindowScale = true
+			options.WindowScale = uint8(min(int(value[0]), MAX_WINDOW_SCALE))
+		case TCP_OPT_SACK_PERMITTED:
+			if length != TCP_OPT_SACK_PERMITTED_LEN {
+				return options, fmt.Errorf("SACK-permitted option has invalid length %d", length)
+			}
+			options.SACKPermitted = true
+		case TCP_OPT_SACK:
+			if len(value) == 0 || len(value)%8 != 0 {
+				return options, fmt.Errorf("SACK option has invalid length %d", length)
+			}
+			for j := 0; j+8 <= len(value); j += 8 {
+				options.SACK = append(options.SACK, SACKBlock{
+					Left:  SequenceNumber(binary.BigEndian.Uint32(value[j : j+4])),
+					Right: SequenceNumber(binary.BigEndian.Uint32(value[j+4 : j+8])),
+				})
+			}
+		case TCP_OPT_TIMESTAMPS:
+			if length != TCP_OPT_TIMESTAMPS_LEN {
+				return options, fmt.Errorf("timestamps option has invalid length %d", length)
+			}
+			options.HasTimestamps = true
+			options.TSVal = binary.BigEndian.Uint32(value[0:4])
+			options.TSEcr = binary.BigEndian.Uint32(value[4:8])
+		}
+
+		i += length
+	}
+
+	return options, nil
+}
+
+// Options we advertise on our SYN, or on the SYN-ACK answering a SYN that carried peer
+// Window scale, SACK and timestamps are only used when both sides send them, so a SYN-ACK
+// only offers the ones the SYN did
+func (socket *NormalSocket) synOptions(peer *TCPOptions) TCPOptions {
+	options := TCPOptions{
+		MSS:            socket.localMSS(),
+		HasWindowScale: true,
+		WindowScale:    socket.rcvWindowShift,
+		SACKPermitted:  true,
+		HasTimestamps:  true,
+		TSVal:          tcpTimestamp(),
+	}
+
+	if peer != nil {
+		options.HasWindowScale = peer.HasWindowScale
+		options.SACKPermitted = peer.SACKPermitted
+		options.HasTimestamps = peer.HasTimestamps
+		options.TSEcr = peer.TSVal
+	}
+	return options
+}
+
+// Largest segment we can receive: the MTU of the interface towards the peer, less the IP and TCP headers
+func (socket *NormalSocket) localMSS() uint16 {
+	iface, err := socket.tcpStack.ipStack.OutgoingInterface(socket.RemoteAddress)
+	if err != nil {
+		return DEFAULT_MSS
+	}
+	return uint16(iface.MaxPayload() - TCP_HEADER_LEN)
+}
+
+// Records what the handshake settled on, given the options of the peer's SYN or SYN-ACK
+// Our SYN offers everything, so what the peer sent is exactly what both sides support
+func (socket *NormalSocket) negotiateOptions(peer *TCPOptions) {
+	// Segments have to fit the peer's receive limit and our own link
+	peerMSS := uint16(DEFAULT_MSS)
+	if peer.MSS != 0 {
+		peerMSS = peer.MSS
+	}
+	socket.snd.MSS = uint32(min(int(peerMSS), int(socket.localMSS())))
+
+	socket.sackPermitted = peer.SACKPermitted
+
+	socket.windowScaling = peer.HasWindowScale
+	if socket.windowScaling {
+		socket.sndWindowShift = peer.WindowScale
+	} else {
+		// Scaling applies in both directions or not at all
+		socket.sndWindowShift = 0
+		socket.rcvWindowShift = 0
+	}
+
+	socket.timestamps = peer.HasTimestamps
+	if socket.timestamps {
+		socket.tsRecent = peer.TSVal
+		socket.tsRecentTime = time.Now()
+	}
+}
+
+// Smallest shift that lets a window of size bytes fit in the 16-bit header field
+func windowShift(size uint32) uint8 {
+	shift := uint8(0)
+	for size>>shift > 0xFFFF && shift < MAX_WINDOW_SCALE {
+		shift++
+	}
+	return shift
+}
+
+// Window field for segments we send, the window in SYNs is never scaled (RFC 7323)
+func (socket *NormalSocket) advertisedWindow() uint16 {
+	return uint16(min(int(socket.rcv.WND>>socket.rcvWindowShift), 0xFFFF))
+}
+
+func synWindow(wnd uint32) uint16 {
+	return uint16(min(int(wnd), 0xFFFF))
+}
+
+// Peer's window from a segment it sent after its SYN
+func (socket *NormalSocket) peerWindow(header *TCPHeader) uint32 {
+	return uint32(header.WindowSize) << socket.sndWindowShift
+}
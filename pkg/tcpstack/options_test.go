@@ -0,0 +1,76 @@
+package tcpstack
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The host on the jumbo link may only send segments as large as the MSS its peer advertised
+func TestMSSClampedToPeer(t *testing.T) {
+	var largest atomic.Int64
+	link := &testLink{
+		delay: time.Millisecond,
+		mtuA:  9000,
+		mtuB:  1400,
+		drop: func(header *TCPHeader, payload []byte) bool {
+			for n := int64(len(payload)); n > largest.Load(); {
+				if largest.CompareAndSwap(largest.Load(), n) {
+					break
+				}
+			}
+			return false
+		},
+	}
+	a, b := newTestPair(t, link)
+	client, server := connectPair(t, a, b, 80)
+
+	// 1400 bytes less the IP and TCP headers
+	const want = 1360
+	if mss := locked(client, func() uint32 { return client.snd.MSS }); mss != want {
+		t.Errorf("client on the 9000 byte link sends %d byte segments, want the peer's %d", mss, want)
+	}
+	if mss := locked(server, func() uint32 { return server.snd.MSS }); mss != want {
+		t.Errorf("server on the 1400 byte link sends %d byte segments, want its own %d", mss, want)
+	}
+
+	data := pattern(256 * 1024)
+	if got := transfer(t, client, server, data); !bytes.Equal(got, data) {
+		t.Fatalf("server received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	if n := largest.Load(); n > want {
+		t.Errorf("largest segment carried %d bytes, more than the %d byte MSS", n, want)
+	}
+}
+
+// Connections get the stack's buffer size, and the window scale the handshake offers follows it
+func TestBufferSizeSetsWindowScale(t *testing.T) {
+	a, b := newTestPair(t, &testLink{})
+	if err := a.tcp.SetBufferSize(MIN_BUFFER_SIZE - 1); err == nil {
+		t.Error("a buffer smaller than MIN_BUFFER_SIZE was accepted")
+	}
+	if err := a.tcp.SetBufferSize(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	client, server := connectPair(t, a, b, 80)
+
+	if size := client.rcv.buf.Capacity(); size != 4<<20 {
+		t.Errorf("client has a %d byte receive buffer, want %d", size, 4<<20)
+	}
+	if size := server.rcv.buf.Capacity(); size != int(DEFAULT_BUFFER_SIZE) {
+		t.Errorf("server has a %d byte receive buffer, want the default %d", size, DEFAULT_BUFFER_SIZE)
+	}
+	// 4 MB needs a shift of 7 to fit the 16-bit window field, 256 KB a shift of 3
+	if shift := locked(server, func() uint8 { return server.sndWindowShift }); shift != 7 {
+		t.Errorf("server scales the client's windows by %d, want 7", shift)
+	}
+	if shift := locked(client, func() uint8 { return client.sndWindowShift }); shift != 3 {
+		t.Errorf("client scales the server's windows by %d, want 3", shift)
+	}
+
+	data := pattern(1 << 20)
+	if got := transfer(t, server, client, data); !bytes.Equal(got, data) {
+		t.Fatalf("client received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+}
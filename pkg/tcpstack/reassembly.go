@@ -0,0 +1,153 @@
+package tcpstack
+
+import (
+	"sort"
+	"sync"
+)
+
+// Out-of-order reassembly
+// Segments that arrive past RCV.NXT wait here until the hole before them is filled. They are kept
+// sorted and merged into disjoint ranges, so retransmitted duplicates and overlapping segments
+// don't pile up, and only bytes inside the receive window are stored, which bounds memory to it.
+// Ranges are compared by their offset from RCV.NXT, so the order holds when sequence numbers wrap
+
+// A contiguous range of received bytes
+type reassemblySegment struct {
+	seq  SequenceNumber
+	data []byte
+}
+
+func (segment *reassemblySegment) end() SequenceNumber {
+	return segment.seq.Add(uint32(len(segment.data)))
+}
+
+type reassemblyQueue struct {
+	mutex    sync.Mutex
+	segments []reassemblySegment // Sorted, with a gap between any two
+	latest   SequenceNumber      // Start of the most recently received segment, SACK reports its block first
+}
+
+// Stores a segment, keeping only the bytes past nxt that fit in a window of wnd bytes
+// Callers normally trim to the window already, this keeps the memory bound regardless
+func (q *reassemblyQueue) insert(seq SequenceNumber, data []byte, nxt SequenceNumber, wnd uint32) {
+	// Bytes before nxt are already in order
+	if seq.LT(nxt) {
+		before := nxt.Sub(seq)
+		if before >= uint32(len(data)) {
+			return
+		}
+		data = data[before:]
+		seq = nxt
+	}
+
+	offset := seq.Sub(nxt)
+	if offset >= wnd {
+		return
+	}
+	if uint32(len(data)) > wnd-offset {
+		data = data[:wnd-offset]
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.discardBelow(nxt)
+	q.latest = seq
+
+	// segments[i:j] overlap or touch the new bytes and get merged with them
+	end := offset + uint32(len(data))
+	i := sort.Search(len(q.segments), func(k int) bool { return q.segments[k].end().Sub(nxt) >= offset })
+	j := i
+	for j < len(q.segments) && q.segments[j].seq.Sub(nxt) <= end {
+		j++
+	}
+
+	pieces := make([]reassemblySegment, 0, j-i+1)
+	pieces = append(pieces, q.segments[i:j]...)
+	k := sort.Search(len(pieces), func(k int) bool { return pieces[k].seq.Sub(nxt) > offset })
+	pieces = append(pieces[:k], append([]reassemblySegment{{seq: seq, data: data}}, pieces[k:]...)...)
+
+	// Grow the first piece with whatever each later one adds past its end, so a run of in-order
+	// segments behind a hole is appended to rather than copied again every time
+	merged := pieces[0]
+	if k == 0 {
+		// The payload belongs to the packet, keep our own copy
+		merged.data = append([]byte(nil), data...)
+	}
+	for _, piece := range pieces[1:] {
+		if covered := merged.end().Sub(piece.seq); covered < uint32(len(piece.data)) {
+			merged.data = append(merged.data, piece.data[covered:]...)
+		}
+	}
+
+	q.segments = append(q.segments[:i], append([]reassemblySegment{merged}, q.segments[j:]...)...)
+}
+
+// Returns everything contiguous from nxt, or nil while there is still a hole before it
+// Touching ranges are merged, so this is all of the newly in-order data. It stays queued until
+// nxt moves past it, so bytes the caller couldn't store are still here next time
+func (q *reassemblyQueue) front(nxt SequenceNumber) []byte {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.discardBelow(nxt)
+	if len(q.segments) == 0 || q.segments[0].seq != nxt {
+		return nil
+	}
+	return q.segments[0].data
+}
+
+// Reports whether anything is queued past nxt
+func (q *reassemblyQueue) empty(nxt SequenceNumber) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.discardBelow(nxt)
+	return len(q.segments) == 0
+}
+
+// Builds SACK blocks for the ranges we hold past nxt
+// The block with the most recently received segment goes first as RFC 2018 asks, the rest follow in order
+func (q *reassemblyQueue) sackBlocks(nxt SequenceNumber) []SACKBlock {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.discardBelow(nxt)
+	if len(q.segments) == 0 {
+		return nil
+	}
+
+	blocks := make([]SACKBlock, 0, len(q.segments))
+	for _, segment := range q.segments {
+		blocks = append(blocks, SACKBlock{Left: segment.seq, Right: segment.end()})
+	}
+
+	for i, block := range blocks {
+		if q.latest.InWindow(block.Left, block.Right.Sub(block.Left)) {
+			copy(blocks[1:i+1], blocks[:i])
+			blocks[0] = block
+			break
+		}
+	}
+
+	return blocks[:min(len(blocks), MAX_SACK_BLOCKS)]
+}
+
+// Drops bytes that came in order some other way, the caller holds the mutex
+func (q *reassemblyQueue) discardBelow(nxt SequenceNumber) {
+	for len(q.segments) > 0 {
+		segment := &q.segments[0]
+		if segment.end().LEQ(nxt) {
+			q.segments = q.segments[1:]
+			continue
+		}
+		if segment.seq.LT(nxt) {
+			segment.data = segment.data[nxt.Sub(segment.seq):]
+			segment.seq = nxt
+		}
+		return
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (ts *TCPStack) ReplInput(scanner *bufio.Scanner) {
@@ -79,16 +80,71 @@ func (ts *TCPStack) ReplInput(scanner *bufio.Scanner) {
 
 	case "rtrinfo":
 		fmt.Println("Retransmission info:")
-		for _, entry := range ts.tcpTable {
+		for _, entry := range ts.tableEntries() {
 			if normalSocket, ok := entry.SocketStruct.(*NormalSocket); ok {
-				fmt.Printf("Socket %d: RTO %v, SRTT %v, RTTVAR %v, Receiving Buffer %v\n",
+				normalSocket.mutex.Lock()
+				fmt.Printf("Socket %d: RTO %v, SRTT %v, RTTVAR %v, Receiving Buffer %v, CC %s, cwnd %d, ssthresh %d, Pacing %.0f B/s, Segments %d, Retransmitted %d, PAWS dropped %d\n",
 					entry.SocketStruct.GetSID(),
 					normalSocket.snd.calculatedRTO,
 					normalSocket.snd.SRTT,
 					normalSocket.snd.RTTVAR,
-					normalSocket.rcv.buf.Length())
+					normalSocket.rcv.buf.Length(),
+					normalSocket.snd.cc.Name(),
+					normalSocket.snd.cwnd,
+					normalSocket.snd.ssthresh,
+					normalSocket.snd.pacingRate,
+					normalSocket.snd.segmentsSent,
+					normalSocket.snd.retransmitted,
+					normalSocket.pawsRejected)
+				normalSocket.mutex.Unlock()
 			}
 		}
+		fmt.Printf("Segments dropped for bad checksums: %d\n", ts.checksumErrors.Load())
+
+	case "cc":
+		if len(args) != 3 {
+			fmt.Printf("Usage: cc <socket ID|default> <%s>\n", strings.Join(CongestionControlNames(), "|"))
+			return
+		}
+		handleCongestionControl(ts, args[1], args[2])
+
+	case "nodelay":
+		if len(args) != 3 || (args[2] != "on" && args[2] != "off") {
+			fmt.Println("Usage: nodelay <socket ID> <on|off>")
+			return
+		}
+		socketID, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println("Invalid socket ID")
+			return
+		}
+		handleNoDelay(ts, socketID, args[2] == "on")
+
+	case "keepalive":
+		usage := "Usage: keepalive <socket ID|default> <off|<idle seconds> <interval seconds> <count>>"
+		var config KeepaliveConfig
+		if len(args) == 3 && args[2] == "off" {
+			// The zero value is off
+		} else if len(args) == 5 {
+			values := make([]int, 3)
+			for i := range values {
+				value, err := strconv.Atoi(args[2+i])
+				if err != nil || value <= 0 {
+					fmt.Println(usage)
+					return
+				}
+				values[i] = value
+			}
+			config = KeepaliveConfig{
+				Idle:     time.Duration(values[0]) * time.Second,
+				Interval: time.Duration(values[1]) * time.Second,
+				Count:    values[2],
+			}
+		} else {
+			fmt.Println(usage)
+			return
+		}
+		handleKeepalive(ts, args[1], config)
 
 	case "rst":
 		if len(args) != 2 {
@@ -228,8 +284,8 @@ func handleList(ts *TCPStack) {
 	fmt.Println("SID\tLocal IP:Port\tRemote IP:Port\tState")
 	fmt.Println("-------------------------------------------------------")
 
-	for _, entry := range ts.tcpTable {
-		state := getStateString(entry.State)
+	for _, entry := range ts.tableEntries() {
+		state := getStateString(entry.state())
 		fmt.Printf("%d\t%s:%d\t%s:%d\t%s\n",
 			entry.SocketStruct.GetSID(),
 			entry.LocalAddress, entry.LocalPort,
@@ -260,6 +316,75 @@ func handleClose(ts *TCPStack, socketID int) {
 	}
 }
 
+func handleCongestionControl(ts *TCPStack, target string, algorithm string) {
+	if target == "default" {
+		if err := ts.SetDefaultCongestionControl(algorithm); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	socketID, err := strconv.Atoi(target)
+	if err != nil {
+		fmt.Println("Invalid socket ID")
+		return
+	}
+
+	socket := ts.getSocketByID(socketID)
+	if socket == nil {
+		fmt.Println("Invalid socket ID")
+		return
+	}
+
+	if normalSocket, ok := socket.(*NormalSocket); ok {
+		if err := normalSocket.SetCongestionControl(algorithm); err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		fmt.Println("Invalid socket type")
+		return
+	}
+}
+
+func handleNoDelay(ts *TCPStack, socketID int, noDelay bool) {
+	socket := ts.getSocketByID(socketID)
+	if socket == nil {
+		fmt.Println("Invalid socket ID")
+		return
+	}
+
+	if normalSocket, ok := socket.(*NormalSocket); ok {
+		normalSocket.SetNoDelay(noDelay)
+	} else {
+		fmt.Println("Invalid socket type")
+	}
+}
+
+func handleKeepalive(ts *TCPStack, target string, config KeepaliveConfig) {
+	if target == "default" {
+		ts.SetDefaultKeepalive(config)
+		return
+	}
+
+	socketID, err := strconv.Atoi(target)
+	if err != nil {
+		fmt.Println("Invalid socket ID")
+		return
+	}
+
+	socket := ts.getSocketByID(socketID)
+	if socket == nil {
+		fmt.Println("Invalid socket ID")
+		return
+	}
+
+	if normalSocket, ok := socket.(*NormalSocket); ok {
+		normalSocket.SetKeepalive(config)
+	} else {
+		fmt.Println("Invalid socket type")
+	}
+}
+
 func handleRSTSend(ts *TCPStack, socketID int) {
 	socket := ts.getSocketByID(socketID)
 	if socket == nil {
@@ -287,7 +412,7 @@ func sendFile(ts *TCPStack, filePath string, addr netip.Addr, port uint16) {
 
 	// See if we are already connected with the destination
 	var socketID int
-	for _, entry := range ts.tcpTable {
+	for _, entry := range ts.tableEntries() {
 		if entry.RemoteAddress == addr && entry.RemotePort == port {
 			socketID = entry.SocketStruct.GetSID()
 			break
@@ -321,7 +446,7 @@ func receiveFile(ts *TCPStack, destFile string, port uint16) {
 
 	// See if we are already connected with the source
 	var socketID int
-	for _, entry := range ts.tcpTable {
+	for _, entry := range ts.tableEntries() {
 		if entry.LocalPort == port {
 			socketID = entry.SocketStruct.GetSID()
 			break
@@ -390,6 +515,10 @@ func printHelp() {
 	fmt.Println("  rtrinfo           				- Show retransmission info")
 	fmt.Println("  cl <socket>       				- Close connection")
 	fmt.Println("  sf <file path> <addr> <port> 	- Send file")
-	fmt.Println("  rf <dest file> <port> 			- Receive file\n")
+	fmt.Println("  rf <dest file> <port> 			- Receive file")
+	fmt.Println("  cc <socket|default> <algorithm>	- Set congestion control")
+	fmt.Println("  nodelay <socket> <on|off>		- Turn Nagle's algorithm off or on")
+	fmt.Println("  keepalive <socket|default> <off|idle interval count>	- Set keepalive, times in seconds")
+	fmt.Println()
 	fmt.Println()
 }
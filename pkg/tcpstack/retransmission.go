@@ -15,7 +15,9 @@ func (socket *NormalSocket) manageRetransmissions() {
 			}
 			// Timer expired naturally
 			fmt.Println("Timer expired at:", t)
+			socket.mutex.Lock()
 			err := socket.retransmitPacket()
+			socket.mutex.Unlock()
 			if err != nil {
 				fmt.Println("Error retransmitting packet: ", err)
 				socket.VClose()
@@ -36,6 +38,47 @@ func (socket *NormalSocket) retransmitPacket() error {
 		return fmt.Errorf("max retransmissions reached")
 	}
 
+	// A timeout is the strongest congestion signal, so the window collapses before we resend
+	// and any fast recovery in progress is abandoned
+	socket.snd.cc.OnRTO(&socket.snd)
+	socket.snd.inRecovery = false
+	socket.snd.dupAcks = 0
+	socket.clearSacked()
+
+	if err := socket.resendPacket(packet); err != nil {
+		return err
+	}
+
+	// Increment retransmissions
+	socket.snd.retransmissions++
+
+	// Double the RTO timer
+	socket.snd.calculatedRTO *= 2
+	// Enforce maximum RTO
+	if socket.snd.calculatedRTO > 60*time.Second {
+		socket.snd.calculatedRTO = 60 * time.Second
+	}
+	socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
+
+	return nil
+}
+
+// Sends an in-flight packet again and restarts its entry with the new send time
+func (socket *NormalSocket) resendPacket(packet *InFlightPacket) error {
+	// A SYN repeats its unscaled window and options, anything later advertises the current ones
+	window := socket.advertisedWindow()
+	options := socket.segmentOptions()
+	if packet.flags&TCP_SYN != 0 {
+		window = packet.windowFlags
+		options = packet.options
+		if options.HasTimestamps {
+			options.TSVal = tcpTimestamp()
+		}
+	} else if len(packet.data)+len(options.marshal()) > int(socket.snd.MSS) {
+		// SACK blocks gained since the first send would push the segment past the MSS
+		options.SACK = nil
+	}
+
 	// Create header for retransmission
 	header := &TCPHeader{
 		SourcePort: socket.LocalPort,
@@ -44,7 +87,8 @@ func (socket *NormalSocket) retransmitPacket() error {
 		AckNum:     socket.rcv.NXT,
 		DataOffset: 5,
 		Flags:      packet.flags,
-		WindowSize: packet.windowFlags,// uint16(socket.rcv.buf.Free()),
+		WindowSize: window,
+		Options:    options,
 	}
 
 	// Retransmit the packet
@@ -62,30 +106,25 @@ func (socket *NormalSocket) retransmitPacket() error {
 		}
 	}
 	socket.snd.inFlightPackets.packets = newPackets
-	socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, InFlightPacket{
+	retransmitted := InFlightPacket{
 		SeqNum:   packet.SeqNum,
+		Length:   packet.Length,
 		flags:    packet.flags,
 		data:     packet.data,
 		timeSent: time.Now(),
 		windowFlags: packet.windowFlags,
-	})
+		options:  packet.options,
+	}
+	socket.snd.stampDelivery(&retransmitted)
+	socket.snd.inFlightPackets.packets = append(socket.snd.inFlightPackets.packets, retransmitted)
 	socket.snd.inFlightPackets.mutex.Unlock()
 
-	// Increment retransmissions
-	socket.snd.retransmissions++
-
-	// Double the RTO timer
-	socket.snd.calculatedRTO *= 2
-	// Enforce maximum RTO
-	if socket.snd.calculatedRTO > 60*time.Second {
-		socket.snd.calculatedRTO = 60 * time.Second
-	}
-	socket.snd.RTOtimer.Reset(socket.snd.calculatedRTO)
+	socket.snd.retransmitted++
 
 	return nil
 }
 
-func (socket *NormalSocket) computeRTO(ackNum uint32, timeReceived time.Time) {
+func (socket *NormalSocket) computeRTO(ackNum SequenceNumber, timeReceived time.Time) {
 	// We need to implement the RTO calculation here
 
 	// Resets RTO calculation
@@ -106,6 +145,11 @@ func (socket *NormalSocket) computeRTO(ackNum uint32, timeReceived time.Time) {
 		}
 	}
 
+	socket.updateRTO(rtt)
+}
+
+// Folds an RTT sample into SRTT and RTTVAR and recalculates the RTO (RFC 6298)
+func (socket *NormalSocket) updateRTO(rtt time.Duration) {
 	// If this is the first RTT measurement
 	if socket.snd.SRTT == 0 {
 		socket.snd.SRTT = rtt
@@ -135,16 +179,22 @@ func (socket *NormalSocket) computeRTO(ackNum uint32, timeReceived time.Time) {
 
 }
 
-// getFirstUnackedPacket returns the first unacknowledged packet from the inflight packets
+// getFirstUnackedPacket returns the unacknowledged packet with the lowest sequence number from the inflight packets
+// Retransmitted packets move to the end of the list, so the first match isn't necessarily the oldest
 // Returns nil if no unacked packets are found
 func (socket *NormalSocket) getFirstUnackedPacket() *InFlightPacket {
 	socket.snd.inFlightPackets.mutex.Lock()
 	defer socket.snd.inFlightPackets.mutex.Unlock()
 
-	for _, packet := range socket.snd.inFlightPackets.packets {
-		if packet.SeqNum >= socket.snd.UNA {
-			return &packet
+	var first *InFlightPacket
+	for i, packet := range socket.snd.inFlightPackets.packets {
+		if packet.SeqNum.GEQ(socket.snd.UNA) && (first == nil || packet.SeqNum.LT(first.SeqNum)) {
+			first = &socket.snd.inFlightPackets.packets[i]
 		}
 	}
-	return nil
+	if first == nil {
+		return nil
+	}
+	packet := *first
+	return &packet
 }
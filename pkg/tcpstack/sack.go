@@ -0,0 +1,96 @@
+package tcpstack
+
+// Selective acknowledgment (RFC 2018)
+// The receiver reports the out-of-order ranges it holds, and the sender marks those packets in
+// its in-flight list so that recovery only resends the holes between them
+
+// Builds SACK blocks from the out-of-order data we hold
+func (socket *NormalSocket) sackBlocks() []SACKBlock {
+	return socket.rcv.earlyData.sackBlocks(socket.rcv.NXT)
+}
+
+// Marks in-flight packets covered by the peer's SACK blocks
+func (socket *NormalSocket) markSacked(blocks []SACKBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+
+	socket.snd.inFlightPackets.mutex.Lock()
+	defer socket.snd.inFlightPackets.mutex.Unlock()
+
+	for i := range socket.snd.inFlightPackets.packets {
+		packet := &socket.snd.inFlightPackets.packets[i]
+		end := packet.SeqNum.Add(uint32(packet.Length))
+		for _, block := range blocks {
+			// Ignore blocks at or below the cumulative ACK, they carry no new information
+			if block.Right.LEQ(socket.snd.UNA) {
+				continue
+			}
+			if block.Left.LEQ(packet.SeqNum) && end.LEQ(block.Right) && packet.Length > 0 {
+				packet.sacked = true
+			}
+		}
+	}
+}
+
+// Forgets SACK information, the receiver is allowed to discard data it reported (RFC 2018)
+func (socket *NormalSocket) clearSacked() {
+	socket.snd.inFlightPackets.mutex.Lock()
+	defer socket.snd.inFlightPackets.mutex.Unlock()
+
+	for i := range socket.snd.inFlightPackets.packets {
+		socket.snd.inFlightPackets.packets[i].sacked = false
+	}
+}
+
+// Returns the lowest packet at or above highRxt that the receiver is missing while holding data past it
+func (socket *NormalSocket) nextHole() *InFlightPacket {
+	socket.snd.inFlightPackets.mutex.Lock()
+	defer socket.snd.inFlightPackets.mutex.Unlock()
+
+	var highestSacked SequenceNumber
+	found := false
+	for _, packet := range socket.snd.inFlightPackets.packets {
+		if packet.sacked && (!found || packet.SeqNum.GT(highestSacked)) {
+			highestSacked = packet.SeqNum
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	var hole *InFlightPacket
+	for i, packet := range socket.snd.inFlightPackets.packets {
+		if packet.sacked || packet.SeqNum.LT(socket.snd.UNA) || packet.SeqNum.LT(socket.snd.highRxt) || packet.SeqNum.GT(highestSacked) {
+			continue
+		}
+		if hole == nil || packet.SeqNum.LT(hole.SeqNum) {
+			hole = &socket.snd.inFlightPackets.packets[i]
+		}
+	}
+	if hole == nil {
+		return nil
+	}
+	packet := *hole
+	return &packet
+}
+
+// Resends the next hole during fast recovery
+// Without SACK information the only hole we know about is the first unacknowledged segment,
+// which is resent once per partial ACK as in NewReno
+func (socket *NormalSocket) retransmitHole() error {
+	var packet *InFlightPacket
+	if socket.sackPermitted {
+		packet = socket.nextHole()
+	}
+	if packet == nil && socket.snd.highRxt.LEQ(socket.snd.UNA) {
+		packet = socket.getFirstUnackedPacket()
+	}
+	if packet == nil {
+		return nil
+	}
+
+	socket.snd.highRxt = packet.SeqNum.Add(uint32(packet.Length))
+	return socket.resendPacket(packet)
+}
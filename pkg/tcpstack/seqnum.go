@@ -0,0 +1,44 @@
+package tcpstack
+
+// Sequence number arithmetic (RFC 9293 section 3.4, RFC 1982)
+// Sequence numbers live on a 32-bit circle and wrap from 2^32-1 back to 0, so plain integer ordering
+// breaks on long transfers or an ISN near the top. a comes before b when b is less than 2^31 ahead of
+// it going around the circle, which is what the signed difference below checks
+
+// A position in sequence space, compare with the methods below rather than < and >
+type SequenceNumber uint32
+
+// Reports whether s comes before other
+func (s SequenceNumber) LT(other SequenceNumber) bool {
+	return int32(s-other) < 0
+}
+
+// Reports whether s comes before or is other
+func (s SequenceNumber) LEQ(other SequenceNumber) bool {
+	return int32(s-other) <= 0
+}
+
+// Reports whether s comes after other
+func (s SequenceNumber) GT(other SequenceNumber) bool {
+	return int32(s-other) > 0
+}
+
+// Reports whether s comes after or is other
+func (s SequenceNumber) GEQ(other SequenceNumber) bool {
+	return int32(s-other) >= 0
+}
+
+// Reports whether s falls in the size bytes starting at start
+func (s SequenceNumber) InWindow(start SequenceNumber, size uint32) bool {
+	return uint32(s-start) < size
+}
+
+// Returns the sequence number n bytes after s
+func (s SequenceNumber) Add(n uint32) SequenceNumber {
+	return s + SequenceNumber(n)
+}
+
+// Returns how many bytes s is past other, only meaningful when other doesn't come after s
+func (s SequenceNumber) Sub(other SequenceNumber) uint32 {
+	return uint32(s - other)
+}
@@ -0,0 +1,128 @@
+package tcpstack
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSequenceNumberComparisons(t *testing.T) {
+	tests := []struct {
+		name string
+		s, o SequenceNumber
+		lt   bool // s comes before o
+		eq   bool
+	}{
+		{"ordinary", 100, 200, true, false},
+		{"ordinary reversed", 200, 100, false, false},
+		{"equal", 5, 5, false, true},
+		{"equal at the top", 0xFFFFFFFF, 0xFFFFFFFF, false, true},
+		{"top before zero", 0xFFFFFFFF, 0, true, false},
+		{"zero after top", 0, 0xFFFFFFFF, false, false},
+		{"across the wrap", 0xFFFFFF00, 0x100, true, false},
+		{"across the wrap reversed", 0x100, 0xFFFFFF00, false, false},
+		{"just under half the circle ahead", 0, 0x7FFFFFFF, true, false},
+		{"just under half the circle behind", 0x7FFFFFFF, 0, false, false},
+		{"more than half the circle ahead is behind", 0x80000001, 0, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gt := !test.lt && !test.eq
+			if got := test.s.LT(test.o); got != test.lt {
+				t.Errorf("%#x.LT(%#x) = %v, want %v", test.s, test.o, got, test.lt)
+			}
+			if got := test.s.LEQ(test.o); got != (test.lt || test.eq) {
+				t.Errorf("%#x.LEQ(%#x) = %v, want %v", test.s, test.o, got, test.lt || test.eq)
+			}
+			if got := test.s.GT(test.o); got != gt {
+				t.Errorf("%#x.GT(%#x) = %v, want %v", test.s, test.o, got, gt)
+			}
+			if got := test.s.GEQ(test.o); got != (gt || test.eq) {
+				t.Errorf("%#x.GEQ(%#x) = %v, want %v", test.s, test.o, got, gt || test.eq)
+			}
+		})
+	}
+}
+
+func TestSequenceNumberInWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     SequenceNumber
+		start SequenceNumber
+		size  uint32
+		want  bool
+	}{
+		{"at the start", 1000, 1000, 10, true},
+		{"last byte", 1009, 1000, 10, true},
+		{"one past the end", 1010, 1000, 10, false},
+		{"one before the start", 999, 1000, 10, false},
+		{"empty window", 1000, 1000, 0, false},
+		{"start at the top", 0xFFFFFFFF, 0xFFFFFFFF, 10, true},
+		{"wrapped inside", 3, 0xFFFFFFFC, 10, true},
+		{"wrapped last byte", 5, 0xFFFFFFFC, 10, true},
+		{"wrapped one past the end", 6, 0xFFFFFFFC, 10, false},
+		{"before a window that wraps", 0xFFFFFFFB, 0xFFFFFFFC, 10, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.s.InWindow(test.start, test.size); got != test.want {
+				t.Errorf("%#x.InWindow(%#x, %d) = %v, want %v", test.s, test.start, test.size, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSequenceNumberArithmetic(t *testing.T) {
+	tests := []struct {
+		s    SequenceNumber
+		n    uint32
+		want SequenceNumber
+	}{
+		{100, 50, 150},
+		{0xFFFFFFFF, 1, 0},
+		{0xFFFFFFF0, 0x20, 0x10},
+		{0, 0, 0},
+	}
+	for _, test := range tests {
+		sum := test.s.Add(test.n)
+		if sum != test.want {
+			t.Errorf("%#x.Add(%d) = %#x, want %#x", test.s, test.n, sum, test.want)
+		}
+		if diff := sum.Sub(test.s); diff != test.n {
+			t.Errorf("%#x.Sub(%#x) = %d, want %d", sum, test.s, diff, test.n)
+		}
+		if test.n > 0 && !sum.GT(test.s) {
+			t.Errorf("%#x.Add(%d) = %#x doesn't come after it", test.s, test.n, sum)
+		}
+	}
+}
+
+// Both ends start just below 2^32, so the handshake, the data and the retransmissions all cross the wrap
+func TestTransferAcrossSequenceWrap(t *testing.T) {
+	isn := generateInitialSeqNum
+	generateInitialSeqNum = func() SequenceNumber { return 0xFFFFFFFF - 3000 }
+	t.Cleanup(func() { generateInitialSeqNum = isn })
+
+	a, b := newTestPair(t, &testLink{delay: 2 * time.Millisecond, drop: lossyDrop(0.02, 1)})
+	client, server := connectPair(t, a, b, 80)
+
+	data := pattern(256 * 1024)
+	if got := transfer(t, client, server, data); !bytes.Equal(got, data) {
+		t.Fatalf("server received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	if got := transfer(t, server, client, data); !bytes.Equal(got, data) {
+		t.Fatalf("client received %d bytes that don't match the %d sent", len(got), len(data))
+	}
+	clientNXT := locked(client, func() SequenceNumber { return client.snd.NXT })
+	serverNXT := locked(server, func() SequenceNumber { return server.snd.NXT })
+	// Compared as plain integers on purpose, to check the numbers really did go through zero
+	if clientNXT >= client.snd.ISS || serverNXT >= server.snd.ISS {
+		t.Fatalf("sequence numbers never wrapped, client %#x to %#x, server %#x to %#x",
+			client.snd.ISS, clientNXT, server.snd.ISS, serverNXT)
+	}
+	clientRetransmitted := locked(client, func() int { return client.snd.retransmitted })
+	serverRetransmitted := locked(server, func() int { return server.snd.retransmitted })
+	if clientRetransmitted == 0 || serverRetransmitted == 0 {
+		t.Fatalf("the link lost nothing, retransmitted %d and %d", clientRetransmitted, serverRetransmitted)
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"time"
 )
 
-func ParseTCPHeader(data []byte) (*TCPHeader, []byte) {
+func ParseTCPHeader(data []byte) (*TCPHeader, []byte, error) {
+	if len(data) < TCP_HEADER_LEN {
+		return nil, nil, fmt.Errorf("segment of %d bytes is shorter than a TCP header", len(data))
+	}
+
 	header := &TCPHeader{
 		SourcePort: binary.BigEndian.Uint16(data[0:2]),
 		DestPort:   binary.BigEndian.Uint16(data[2:4]),
-		SeqNum:     binary.BigEndian.Uint32(data[4:8]),
-		AckNum:     binary.BigEndian.Uint32(data[8:12]),
+		SeqNum:     SequenceNumber(binary.BigEndian.Uint32(data[4:8])),
+		AckNum:     SequenceNumber(binary.BigEndian.Uint32(data[8:12])),
 		DataOffset: data[12] >> 4,
 		Flags:      data[13],
 		WindowSize: binary.BigEndian.Uint16(data[14:16]),
@@ -20,24 +24,33 @@ func ParseTCPHeader(data []byte) (*TCPHeader, []byte) {
 	}
 
 	headerLen := int(header.DataOffset) * 4
-	return header, data[headerLen:]
+	if headerLen < TCP_HEADER_LEN || headerLen > len(data) {
+		return nil, nil, fmt.Errorf("invalid data offset %d for a %d byte segment", header.DataOffset, len(data))
+	}
+
+	options, err := parseTCPOptions(data[TCP_HEADER_LEN:headerLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Options = options
+
+	return header, data[headerLen:], nil
 }
 
 // Add these helper functions
 func serializeTCPPacket(header *TCPHeader, payload []byte) []byte {
-	if len(payload) > MAX_TCP_PAYLOAD {
-		fmt.Printf("Payload is too large, max is %d, got %d\n", MAX_TCP_PAYLOAD, len(payload))
-		return nil
-	}
-	
-	// 20 bytes for header
-	packet := make([]byte, 20+len(payload))
+	// 20 bytes for header, plus options
+	// Segments are sized to the MSS by the sender, and the IP layer drops anything over the link MTU
+	options := header.Options.marshal()
+	headerLen := TCP_HEADER_LEN + len(options)
+	header.DataOffset = uint8(headerLen / 4)
+	packet := make([]byte, headerLen+len(payload))
 
 	// Write header fields
 	binary.BigEndian.PutUint16(packet[0:2], header.SourcePort)
 	binary.BigEndian.PutUint16(packet[2:4], header.DestPort)
-	binary.BigEndian.PutUint32(packet[4:8], header.SeqNum)
-	binary.BigEndian.PutUint32(packet[8:12], header.AckNum)
+	binary.BigEndian.PutUint32(packet[4:8], uint32(header.SeqNum))
+	binary.BigEndian.PutUint32(packet[8:12], uint32(header.AckNum))
 
 	// Data offset and flags
 	packet[12] = header.DataOffset << 4
@@ -47,9 +60,11 @@ func serializeTCPPacket(header *TCPHeader, payload []byte) []byte {
 	binary.BigEndian.PutUint16(packet[16:18], 0) // Zero checksum initially
 	binary.BigEndian.PutUint16(packet[18:20], header.UrgentPtr)
 
+	copy(packet[TCP_HEADER_LEN:], options)
+
 	// Add payload if any
 	if len(payload) > 0 {
-		copy(packet[20:], payload)
+		copy(packet[headerLen:], payload)
 	}
 
 	return packet
@@ -95,8 +110,9 @@ func computeChecksum(srcIP, dstIP []byte, protocol uint8, tcpPacket []byte) uint
 	return ^uint16(sum) 
 }
 
-func generateInitialSeqNum() uint32 {
+// A variable so tests can start a connection anywhere in sequence space
+var generateInitialSeqNum = func() SequenceNumber {
 	// For now, use a simple random number
-	return uint32(time.Now().UnixNano() & 0xFFFFFFFF)
+	return SequenceNumber(time.Now().UnixNano() & 0xFFFFFFFF)
 }
 
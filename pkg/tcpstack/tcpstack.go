@@ -1,22 +1,38 @@
 package tcpstack
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"ip-rip-in-peace/pkg/ipstack"
 	"net/netip"
-	// "encoding/binary"
 )
 
 func InitTCPStack(ipStack *ipstack.IPStack) *TCPStack {
-	fmt.Println("BUFFER_SIZE: ", BUFFER_SIZE)
-
 	result := &TCPStack{
-		tcpTable: make([]TCPTableEntry, 0),
+		tcpTable: make([]*TCPTableEntry, 0),
 		ipStack:  ipStack,
 		nextPort: 49152, // Start of ephemeral port range
 		nextSID: 0,
+		congestionControl: DEFAULT_CONGESTION_CONTROL,
+		delayedAckTimeout: DEFAULT_DELAYED_ACK_TIMEOUT,
+		bufferSize:        DEFAULT_BUFFER_SIZE,
+	}
+	result.loopback.signal = make(chan struct{}, 1)
+	go result.deliverLoopback()
+	if ipStack.IPConfig != nil {
+		result.delayedAckTimeout = ipStack.IPConfig.TcpDelayedAck
+		// The parser keeps it within MIN_BUFFER_SIZE and MAX_BUFFER_SIZE
+		if size := ipStack.IPConfig.TcpBufferSize; size != 0 {
+			result.bufferSize = size
+		}
+		result.keepalive = KeepaliveConfig{
+			Idle:     ipStack.IPConfig.TcpKeepaliveIdle,
+			Interval: ipStack.IPConfig.TcpKeepaliveInterval,
+			Count:    ipStack.IPConfig.TcpKeepaliveCount,
+		}
 	}
+	fmt.Println("Buffer size: ", result.bufferSize)
 
 	// This is not blocking, it is erroring on a read, we need to call it before any read or write calls
 	// Sending when buffer is full should also block
@@ -27,13 +43,29 @@ func InitTCPStack(ipStack *ipstack.IPStack) *TCPStack {
 	return result
 }
 
+// Sets the send and receive buffer size of connections created from now on
+// The buffers bound the windows, so this is also the most a connection can have in flight
+func (ts *TCPStack) SetBufferSize(size uint32) error {
+	if size < MIN_BUFFER_SIZE || size > MAX_BUFFER_SIZE {
+		return fmt.Errorf("buffer size must be between %d and %d bytes", MIN_BUFFER_SIZE, MAX_BUFFER_SIZE)
+	}
+	ts.bufferSize = size
+	return nil
+}
+
 func (ts *TCPStack) generateSID() int {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
 	nextSID := ts.nextSID
 	ts.nextSID++
 	return nextSID
 }
 
 func (ts *TCPStack) getSocketByID(id int) Socket {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
 	for _, e := range ts.tcpTable {
 		if e.SocketStruct.GetSID() == id {
 			return e.SocketStruct
@@ -42,7 +74,7 @@ func (ts *TCPStack) getSocketByID(id int) Socket {
 	return nil
 }
 
-func (ts *TCPStack) VInsertTableEntry(entry TCPTableEntry) {
+func (ts *TCPStack) VInsertTableEntry(entry *TCPTableEntry) {
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
 	ts.tcpTable = append(ts.tcpTable, entry)
@@ -52,35 +84,55 @@ func (ts *TCPStack) VInsertTableEntry(entry TCPTableEntry) {
 	}
 }
 
-func (ts *TCPStack) VDeleteTableEntry(entry TCPTableEntry) {
+func (ts *TCPStack) VDeleteTableEntry(entry *TCPTableEntry) {
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
 	for i, e := range ts.tcpTable {
 		if e == entry {
 			ts.tcpTable = append(ts.tcpTable[:i], ts.tcpTable[i+1:]...)
+			switch entry.SocketStruct.(type) {
+			case *NormalSocket:
+				// Nothing is left for keepalive to probe
+				entry.SocketStruct.(*NormalSocket).stopKeepalive()
+			}
+			return
 		}
 	}
 }
 
+// Returns a copy of the table, so callers can go through it without holding the stack's mutex
+func (ts *TCPStack) tableEntries() []*TCPTableEntry {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return append([]*TCPTableEntry(nil), ts.tcpTable...)
+}
+
+// Returns the entry's state, which the packet handler may be changing under the socket's mutex
+func (entry *TCPTableEntry) state() TCPState {
+	if socket, ok := entry.SocketStruct.(*NormalSocket); ok {
+		socket.mutex.Lock()
+		defer socket.mutex.Unlock()
+	}
+	return entry.State
+}
+
 // Returns the entry if found, otherwise returns nil and an error
 func (ts *TCPStack) VFindTableEntry(localAddress netip.Addr, localPort uint16, remoteAddress netip.Addr, remotePort uint16) (*TCPTableEntry, error) {
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
 
 	// First, check if full 4-tuple match
-	for i := range ts.tcpTable {
-		e := &ts.tcpTable[i]
+	for _, e := range ts.tcpTable {
 		if e.LocalPort == localPort &&
 			e.RemoteAddress == remoteAddress && e.RemotePort == remotePort {
 			return e, nil
 		}
 	}
 
-	// Second, check for listening socket
-	for i := range ts.tcpTable {
-		e := &ts.tcpTable[i]
-		if e.LocalPort == localPort &&
-			e.State == TCP_LISTEN {
+	// Second, check for listening socket, by type since the state of other entries can change under us
+	for _, e := range ts.tcpTable {
+		if _, listening := e.SocketStruct.(*ListenSocket); listening &&
+			e.LocalPort == localPort {
 			return e, nil
 		}
 	}
@@ -90,31 +142,29 @@ func (ts *TCPStack) VFindTableEntry(localAddress netip.Addr, localPort uint16, r
 }
 
 func (ts *TCPStack) sendPacket(dstAddr netip.Addr, data []byte) error {
-	// Get source IP from the first interface
-	// var srcIP []byte
-	// for _, iface := range ts.ipStack.Interfaces {
-	// 	srcIP = iface.IPAddr.AsSlice()
-	// 	break
-	// }
-	
-	// // Calculate TCP checksum with pseudo header
-	// checksum := computeChecksum(
-	// 	srcIP,
-	// 	dstAddr.AsSlice(),
-	// 	uint8(ipstack.TCP_PROTOCOL),
-	// 	data,
-	// )
-	
-	// // Insert TCP checksum into packet
-	// binary.BigEndian.PutUint16(data[16:18], checksum)
-	
-	// fmt.Printf("Sending TCP packet:\n")
-	// fmt.Printf("  Length: %d\n", len(data))
-	// fmt.Printf("  Source IP: %v\n", srcIP)
-	// fmt.Printf("  Dest IP: %v\n", dstAddr.AsSlice())
-	// fmt.Printf("  First 20 bytes: %v\n", data[:20])
-	
-	return ts.ipStack.SendIP(dstAddr, ipstack.TCP_PROTOCOL, 16, data)
+	// The checksum covers the source address, so it has to be the one the IP layer will use
+	iface, err := ts.ipStack.OutgoingInterface(dstAddr)
+	if err != nil {
+		return err
+	}
+
+	// Calculate TCP checksum with pseudo header
+	binary.BigEndian.PutUint16(data[16:18], 0)
+	checksum := computeChecksum(
+		iface.IPAddr.AsSlice(),
+		dstAddr.AsSlice(),
+		uint8(ipstack.TCP_PROTOCOL),
+		data,
+	)
+
+	// Insert TCP checksum into packet
+	binary.BigEndian.PutUint16(data[16:18], checksum)
+
+	if ts.isLocalAddress(dstAddr) {
+		ts.sendLoopback(iface.IPAddr, dstAddr, data)
+		return nil
+	}
+	return ts.ipStack.SendIPFrom(iface.IPAddr, dstAddr, ipstack.TCP_PROTOCOL, 16, data)
 }
 
 func (ts *TCPStack) allocatePort() uint16 {
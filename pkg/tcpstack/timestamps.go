@@ -0,0 +1,68 @@
+package tcpstack
+
+import "time"
+
+// TCP timestamps (RFC 7323)
+// Once negotiated, every segment carries our clock in TSval and echoes the peer's latest TSval in TSecr.
+// An ACK's TSecr tells exactly which transmission it answers, so each ACK gives an RTT sample even
+// after retransmissions, and PAWS can reject old duplicates whose sequence numbers became valid again
+// after the sequence space wrapped
+
+// After this long without hearing from the peer its timestamp clock may have wrapped, so TS.Recent
+// can't be trusted for PAWS anymore (RFC 7323 section 5.5)
+const PAWS_IDLE_LIMIT = 24 * 24 * time.Hour
+
+// Our timestamp clock, ticking once per millisecond (RFC 7323 allows 1 ms to 1 s)
+// It starts at 1 so that a TSecr of 0 always means there is nothing to echo
+var timestampEpoch = time.Now()
+
+func tcpTimestamp() uint32 {
+	return uint32(time.Since(timestampEpoch).Milliseconds()) + 1
+}
+
+// RTT measured from the TSecr of an ACK
+func timestampRTT(tsecr uint32) time.Duration {
+	return time.Duration(tcpTimestamp()-tsecr) * time.Millisecond
+}
+
+// Options for a segment we are about to send after the handshake
+func (socket *NormalSocket) segmentOptions() TCPOptions {
+	var options TCPOptions
+	if socket.sackPermitted {
+		options.SACK = socket.sackBlocks()
+	}
+	if socket.timestamps {
+		options.HasTimestamps = true
+		options.TSVal = tcpTimestamp()
+		options.TSEcr = socket.tsRecent
+	}
+	return options
+}
+
+// PAWS check, returns false for a segment with a timestamp older than the newest one we accepted
+// Accepted segments at or below rcv.NXT update TS.Recent, so out of order segments don't move it forward
+func (socket *NormalSocket) acceptTimestamp(header *TCPHeader) bool {
+	if !socket.timestamps || !header.Options.HasTimestamps || header.Flags&TCP_RST != 0 {
+		return true
+	}
+
+	tsval := header.Options.TSVal
+	if int32(tsval-socket.tsRecent) < 0 && time.Since(socket.tsRecentTime) < PAWS_IDLE_LIMIT {
+		socket.pawsRejected++
+		return false
+	}
+
+	if header.SeqNum.LEQ(socket.rcv.NXT) {
+		socket.tsRecent = tsval
+		socket.tsRecentTime = time.Now()
+	}
+	return true
+}
+
+// Takes an RTT sample from the TSecr of an ACK that acknowledged new data
+func (socket *NormalSocket) sampleTimestampRTT(header *TCPHeader) {
+	if !socket.timestamps || !header.Options.HasTimestamps || header.Options.TSEcr == 0 {
+		return
+	}
+	socket.updateRTO(timestampRTT(header.Options.TSEcr))
+}
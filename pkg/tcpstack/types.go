@@ -4,6 +4,7 @@ import (
 	"ip-rip-in-peace/pkg/ipstack"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/smallnest/ringbuffer"
 )
@@ -11,13 +12,14 @@ import (
 type TCPHeader struct {
 	SourcePort uint16
 	DestPort   uint16
-	SeqNum     uint32
-	AckNum     uint32
+	SeqNum     SequenceNumber
+	AckNum     SequenceNumber
 	DataOffset uint8 // 4 bits
 	Flags      uint8 // 8 bits
 	WindowSize uint16
 	Checksum   uint16
 	UrgentPtr  uint16
+	Options    TCPOptions
 }
 
 const (
@@ -29,7 +31,7 @@ const (
 )
 
 type TCPStack struct {
-	tcpTable []TCPTableEntry
+	tcpTable []*TCPTableEntry
 	mutex    sync.Mutex
 	ipStack  *ipstack.IPStack
 	// rcv      RCV
@@ -37,19 +39,56 @@ type TCPStack struct {
 	// snd and rcv should be on the level of socket connection, not the stack which is a per host/client level
 	nextPort uint16 // For ephemeral port allocation
 	nextSID  int
+
+	congestionControl string        // Algorithm given to new sockets
+	delayedAckTimeout time.Duration // Given to new sockets, see SetDelayedAckTimeout
+	bufferSize        uint32        // Send and receive buffer size of new sockets, see SetBufferSize
+	keepalive         KeepaliveConfig // Given to new sockets, see SetDefaultKeepalive
+
+	checksumErrors atomic.Uint64 // Segments dropped for a bad checksum
+	loopback       loopbackQueue // Segments to our own addresses, see loopback.go
 }
 
 type SND struct {
 	buf             *ringbuffer.RingBuffer
-	UNA             uint32        // oldest unacknowledged sequence number
-	NXT             uint32        // next sequence number to be sent
-	WND             uint16        // peer's advertised window size
-	ISS             uint32        // initial send sequence number
-	calculatedRTO   time.Duration // RTO for that connection, calculated based on RTT
-	RTOtimer        *time.Timer   // Timer for RTO
-	SRTT            time.Duration // Smoothed RTT
-	RTTVAR          time.Duration // RTT variance
+	UNA             SequenceNumber // oldest unacknowledged sequence number
+	NXT             SequenceNumber // next sequence number to be sent
+	WND             uint32         // peer's advertised window size, already scaled
+	MSS             uint32         // Largest payload we send in one segment, options included
+	ISS             SequenceNumber // initial send sequence number
+	calculatedRTO   time.Duration  // RTO for that connection, calculated based on RTT
+	RTOtimer        *time.Timer    // Timer for RTO
+	SRTT            time.Duration  // Smoothed RTT
+	RTTVAR          time.Duration  // RTT variance
 	retransmissions int
+	retransmitted   int // Segments retransmitted over the life of the connection
+	segmentsSent    int // Data segments sent over the life of the connection, not counting retransmissions
+
+	sendMutex   sync.Mutex  // Held by trySendData so only one goroutine sends at a time
+	sendPending atomic.Bool // A goroutine is queued to send what Nagle held back
+
+	// Congestion control, cwnd limits how much we send along with WND
+	cwnd     uint32
+	ssthresh uint32
+	cc       CongestionControl
+
+	// Fast retransmit and fast recovery (RFC 6582)
+	dupAcks    int            // Duplicate ACKs in a row
+	inRecovery bool           // Set from the fast retransmit until everything sent before it is acknowledged
+	recover    SequenceNumber // NXT when recovery started
+	highRxt    SequenceNumber // End of the highest segment retransmitted in this recovery, so each hole is resent once
+
+	// Pacing, set by algorithms that spread segments out instead of sending them back to back
+	pacingRate   float64   // Bytes per second, 0 sends as fast as the windows allow
+	nextSendTime time.Time // Earliest time the next segment may go out
+	pacingTimer  *time.Timer   // Sends what pacing held back once nextSendTime comes, nil when not armed
+	pacingSignal chan struct{} // Wakes VClose waiting for the pacing timer
+	ackSignal    chan struct{} // Wakes a sender waiting for the window to open
+
+	// Delivery rate sampling, see stampDelivery
+	delivered     uint64    // Total bytes acknowledged
+	deliveredTime time.Time // When delivered last grew
+	firstSentTime time.Time // Send time of the packet most recently acknowledged
 
 	// add the retransmission/in flight packet tracker, which could be a stack containing all of the segments (with each segment being data, the sequence number, length of segment, and the time it was last sent)
 	inFlightPackets InFlightPacketStack
@@ -57,17 +96,17 @@ type SND struct {
 
 type RCV struct {
 	buf *ringbuffer.RingBuffer
-	WND uint16
-	NXT uint32 // next expected sequence number
-	IRS uint32 // initial receive sequence number
+	WND uint32
+	NXT SequenceNumber // next expected sequence number
+	IRS SequenceNumber // initial receive sequence number
 
-	earlyData []EarlyData
-}
+	earlyData reassemblyQueue // Data past NXT, see reassembly.go
 
-type EarlyData struct {
-	data   []byte
-	SeqNum uint32
-	Length uint16
+	// Delayed ACKs, see ackInOrderData
+	ackMutex          sync.Mutex
+	unackedSegments   int         // Full-sized in-order segments received since our last ACK
+	ackTimer          *time.Timer // Sends the delayed ACK, nil when none is pending
+	delayedAckTimeout time.Duration
 }
 
 type TCPTableEntry struct {
@@ -102,32 +141,77 @@ const (
 
 type InFlightPacket struct {
 	data     []byte // This may be too much overhead to track the data of every in flight packet
-	SeqNum   uint32
+	SeqNum   SequenceNumber
 	Length   uint16
 	timeSent time.Time
 	flags    uint8
-	windowFlags uint16
+	windowFlags uint16 // Window field as sent, so SYNs go out unscaled again
+	sacked   bool // The receiver reported holding this packet in a SACK block
+	options  TCPOptions // Options to resend with, only set for SYNs
+
+	// Connection delivery state when this packet was sent, for delivery rate samples
+	delivered     uint64
+	deliveredTime time.Time
+	firstSentTime time.Time
 	//CalculatedRTO time.Duration // This should be done per connection, not per packet
 }
 
+// Sequence space the packet takes up, SYN and FIN count as one byte each
+func (packet *InFlightPacket) seqLength() uint32 {
+	length := uint32(packet.Length)
+	if packet.flags&(TCP_SYN|TCP_FIN) != 0 {
+		length++
+	}
+	return length
+}
+
 type InFlightPacketStack struct {
 	packets []InFlightPacket
 	mutex   sync.Mutex
 }
 
+// Number of packets in flight, for callers that don't hold the socket's mutex
+func (stack *InFlightPacketStack) length() int {
+	stack.mutex.Lock()
+	defer stack.mutex.Unlock()
+	return len(stack.packets)
+}
+
 type NormalSocket struct {
 	SID           int
 	LocalAddress  netip.Addr
 	LocalPort     uint16
 	RemoteAddress netip.Addr
 	RemotePort    uint16
-	SeqNum        uint32
-	AckNum        uint32
+	SeqNum        SequenceNumber
+	AckNum        SequenceNumber
 	tcpStack      *TCPStack
+	// Guards snd, rcv, the rest of the connection state below and the State of the socket's table entry
+	// The packet handler, the timers and the user calls all take it. Lock order is snd.sendMutex, then
+	// this, then the stack's mutex and the smaller mutexes inside snd and rcv
+	mutex         sync.Mutex
 	snd           SND
 	rcv           RCV
-	lastActive    time.Time
+	lastActive    time.Time // When we last heard from the peer
 	establishedChan chan struct{}
+	noDelay         bool // Nagle's algorithm is off, see SetNoDelay
+	closeErr        error // Why the connection was torn down, see abort
+
+	// Keepalive, see keepaliveTick
+	keepalive       KeepaliveConfig
+	keepaliveMutex  sync.Mutex
+	keepaliveTimer  *time.Timer
+	keepaliveProbes int // Probes sent since we last heard from the peer
+
+	// Negotiated on the handshake, see negotiateOptions
+	sackPermitted  bool   // Both sides sent SACK-permitted
+	windowScaling  bool   // Both sides sent a window scale
+	sndWindowShift uint8  // Shift for the peer's advertised windows
+	rcvWindowShift uint8  // Shift for the windows we advertise
+	timestamps     bool      // Both sides sent timestamps
+	tsRecent       uint32    // Latest timestamp from the peer, echoed back in TSecr
+	tsRecentTime   time.Time // When tsRecent was last updated
+	pawsRejected   int       // Segments dropped by PAWS
 }
 
 type ListenSocket struct {